@@ -0,0 +1,19 @@
+// Package manifest locates (and, on Windows, registers) the native
+// messaging host manifest file for each supported browser, so that both the
+// native-host binary's own -install flow and the proxy's can share the same
+// per-OS, per-browser directory/registry logic instead of keeping two
+// copies in sync.
+package manifest
+
+// Browser identifies which native messaging host registry the manifest is
+// installed for. Chrome, Chromium, and Edge share a manifest shape; Firefox
+// keys callers by allowed_extensions instead of allowed_origins and lives
+// in its own per-OS directories.
+type Browser string
+
+const (
+	BrowserChrome   Browser = "chrome"
+	BrowserChromium Browser = "chromium"
+	BrowserFirefox  Browser = "firefox"
+	BrowserEdge     Browser = "edge"
+)
@@ -0,0 +1,103 @@
+//go:build !windows
+// +build !windows
+
+package manifest
+
+import (
+	"fmt"
+	"os/user"
+	"runtime"
+)
+
+// GetPath returns the path to write packageName's manifest to. On macOS and
+// Linux, each browser scans a fixed per-user directory (or a per-machine one,
+// used here only when the current user can't be looked up) for manifest
+// files, so nothing further needs to be registered.
+func GetPath(browser Browser, packageName string) (path string, err error) {
+	u, _ := user.Current()
+	switch runtime.GOOS {
+	case "darwin":
+		dir, dirErr := darwinManifestDir(browser, u == nil)
+		if dirErr != nil {
+			return "", dirErr
+		}
+		if u != nil {
+			path = fmt.Sprintf("%s/%s/%s.json", u.HomeDir, dir, packageName)
+		} else {
+			path = fmt.Sprintf("%s/%s.json", dir, packageName)
+		}
+	case "linux":
+		dir, dirErr := linuxManifestDir(browser, u == nil)
+		if dirErr != nil {
+			return "", dirErr
+		}
+		if u != nil {
+			path = fmt.Sprintf("%s/%s/%s.json", u.HomeDir, dir, packageName)
+		} else {
+			path = fmt.Sprintf("%s/%s.json", dir, packageName)
+		}
+	default:
+		err = fmt.Errorf("not sure where to install manifest file on platform %s", runtime.GOOS)
+	}
+	return
+}
+
+// RegisterPath is a no-op on platforms where the manifest's own location is
+// what browsers scan.
+func RegisterPath(browser Browser, packageName, manifestPath string) error {
+	return nil
+}
+
+func darwinManifestDir(browser Browser, isRoot bool) (string, error) {
+	switch browser {
+	case BrowserChrome:
+		if isRoot {
+			return "/Library/Google/Chrome/NativeMessagingHosts", nil
+		}
+		return "Library/Application Support/Google/Chrome/NativeMessagingHosts", nil
+	case BrowserChromium:
+		if isRoot {
+			return "/Library/Application Support/Chromium/NativeMessagingHosts", nil
+		}
+		return "Library/Application Support/Chromium/NativeMessagingHosts", nil
+	case BrowserEdge:
+		if isRoot {
+			return "/Library/Microsoft/Edge/NativeMessagingHosts", nil
+		}
+		return "Library/Application Support/Microsoft Edge/NativeMessagingHosts", nil
+	case BrowserFirefox:
+		if isRoot {
+			return "/Library/Application Support/Mozilla/NativeMessagingHosts", nil
+		}
+		return "Library/Application Support/Mozilla/NativeMessagingHosts", nil
+	default:
+		return "", fmt.Errorf("unsupported browser for darwin: %s", browser)
+	}
+}
+
+func linuxManifestDir(browser Browser, isRoot bool) (string, error) {
+	switch browser {
+	case BrowserChrome:
+		if isRoot {
+			return "/etc/opt/chrome/native-messaging-hosts", nil
+		}
+		return ".config/google-chrome/NativeMessagingHosts", nil
+	case BrowserChromium:
+		if isRoot {
+			return "/etc/chromium/native-messaging-hosts", nil
+		}
+		return ".config/chromium/NativeMessagingHosts", nil
+	case BrowserEdge:
+		if isRoot {
+			return "/etc/opt/microsoft/msedge/native-messaging-hosts", nil
+		}
+		return ".config/microsoft-edge/NativeMessagingHosts", nil
+	case BrowserFirefox:
+		if isRoot {
+			return "/usr/lib/mozilla/native-messaging-hosts", nil
+		}
+		return ".mozilla/native-messaging-hosts", nil
+	default:
+		return "", fmt.Errorf("unsupported browser for linux: %s", browser)
+	}
+}
@@ -0,0 +1,54 @@
+//go:build windows
+// +build windows
+
+package manifest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// GetPath returns the path to write packageName's manifest to. On Windows
+// there's no fixed directory browsers scan for manifests; instead each
+// browser looks up the manifest's path from the registry, so the file
+// itself just needs somewhere stable to live.
+func GetPath(browser Browser, packageName string) (string, error) {
+	dir := filepath.Join(os.Getenv("LOCALAPPDATA"), "web-adb", "native-messaging-hosts")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, packageName+".json"), nil
+}
+
+func RegisterPath(browser Browser, packageName, manifestPath string) error {
+	keyPath, err := registryKeyPath(browser, packageName)
+	if err != nil {
+		return err
+	}
+
+	key, _, err := registry.CreateKey(registry.CURRENT_USER, keyPath, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer key.Close()
+
+	return key.SetStringValue("", manifestPath)
+}
+
+func registryKeyPath(browser Browser, packageName string) (string, error) {
+	switch browser {
+	case BrowserChrome:
+		return `Software\Google\Chrome\NativeMessagingHosts\` + packageName, nil
+	case BrowserChromium:
+		return `Software\Chromium\NativeMessagingHosts\` + packageName, nil
+	case BrowserEdge:
+		return `Software\Microsoft\Edge\NativeMessagingHosts\` + packageName, nil
+	case BrowserFirefox:
+		return `Software\Mozilla\NativeMessagingHosts\` + packageName, nil
+	default:
+		return "", fmt.Errorf("unsupported browser for windows: %s", browser)
+	}
+}
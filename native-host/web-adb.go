@@ -4,6 +4,7 @@ For more info on Chrome Native Messaging, see https://developer.chrome.com/exten
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
@@ -14,40 +15,74 @@ import (
 	"io/ioutil"
 	"log"
 	"log/syslog"
+	"net"
 	"os"
-	"os/user"
+	"path"
 	"path/filepath"
-	"runtime"
+	"strings"
+	"sync"
 
 	"github.com/pborman/uuid"
 	"github.com/zach-klippenstein/goadb"
+	"github.com/zach-klippenstein/web-adb/manifest"
 )
 
 var (
 	install     = flag.Bool("install", false, "Install the native messaging host manifest file.")
 	extensionId = flag.String("extension-id", "", "Extension ID to use when installing. Required with -install.")
 	binaryPath  = flag.String("path", "", "Path to native host binary. Default is the path to the current executable.")
+	browser     = flag.String("browser", "chrome", "Browser to install the manifest for: chrome, chromium, firefox, or edge.")
 )
 
 var byteOrder = binary.LittleEndian
 var ErrMsgTooLarge = errors.New("message too large")
 
+// stdoutMu serializes writes to stdout between the main request/response
+// loop and any goroutines sending unsolicited messages (e.g. device-event),
+// since they share the same pipe.
+var stdoutMu sync.Mutex
+
+// rootCtx is cancelled once stdin closes, tearing down every outstanding
+// forward, reverse, and proxy-connect stream along with it. Set in doMain
+// before any request can reach handleRequest.
+var (
+	rootCtx    context.Context
+	rootCancel context.CancelFunc
+)
+
 const (
 	// 1 MB
 	MaxOutgoingMsgLen = 1024 * 1024
 )
 
+// Browser identifies which native messaging host registry the manifest is
+// installed for; see the manifest package for the per-OS/per-browser path
+// and registry logic shared with the proxy binary.
+type Browser = manifest.Browser
+
+const (
+	BrowserChrome   = manifest.BrowserChrome
+	BrowserChromium = manifest.BrowserChromium
+	BrowserFirefox  = manifest.BrowserFirefox
+	BrowserEdge     = manifest.BrowserEdge
+)
+
 var ChromeManifest = struct {
 	// Only lowercase alphanums, underscores, and dots are allowed.
-	Name           string   `json:"name"`
-	Description    string   `json:"description"`
-	Path           string   `json:"path"`
-	Type           string   `json:"type"`
-	AllowedOrigins []string `json:"allowed_origins"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Path        string `json:"path"`
+	Type        string `json:"type"`
+
+	AllowedOrigins    []string `json:"allowed_origins,omitempty"`
+	AllowedExtensions []string `json:"allowed_extensions,omitempty"`
+
+	Browser Browser `json:"-"`
 }{
 	Name:        "com.zachklipp.adb.nativeproxy",
 	Description: "web-adb native messaging proxy",
 	Type:        "stdio",
+	Browser:     BrowserChrome,
 }
 
 type Request struct {
@@ -96,6 +131,244 @@ type PushChunkResponse struct {
 	Error string `json:"error,omitempty"`
 }
 
+// Request to pull a file from the device.
+type PullFileRequest struct {
+	DevicePath string `json:"device_path"`
+}
+
+type PullFileResponse struct {
+	// Device serial to opened stream ID, for devices a pull could be started on.
+	StreamIDs map[string]string `json:"stream_ids"`
+	// Device serial to error, for devices the pull could not be started on.
+	DeviceErrors map[string]string `json:"device_errors"`
+}
+
+type PullChunkRequest struct {
+	// ID from the PullFileResponse.
+	StreamID string `json:"stream_id"`
+	// 0-based index of the chunk being requested; must be the stream's next chunk.
+	ChunkIndex int64 `json:"chunk_index"`
+}
+
+type PullChunkResponse struct {
+	ChunkHeader
+	// Base64-encoded data for the chunk. May be non-empty on the chunk that
+	// reports EndOfStream.
+	Data  string `json:"data,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Request to push a local directory tree onto the device, preserving
+// relative paths and mtimes.
+type PushDirRequest struct {
+	LocalPath  string `json:"local_path"`
+	DevicePath string `json:"device_path"`
+}
+
+// Request to pull a device directory tree onto the local filesystem,
+// preserving relative paths and mtimes.
+type PullDirRequest struct {
+	DevicePath string `json:"device_path"`
+	LocalPath  string `json:"local_path"`
+}
+
+// DirSyncResult is the outcome of syncing one directory tree, for one
+// device. A file failing to transfer is recorded in Errors rather than
+// aborting the rest of the tree.
+type DirSyncResult struct {
+	FilesTransferred int `json:"files_transferred"`
+	// Errors for files/dirs that failed to transfer, keyed by path relative
+	// to the root of the transfer.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+type PushDirResponse struct {
+	DirSyncResult
+}
+
+type PullDirResponse struct {
+	// Per-device results, keyed by serial.
+	Results map[string]DirSyncResult `json:"results"`
+}
+
+// Request to run a single command to completion on one device.
+// req.DeviceSerial must be set; unlike push/pull, output can't be
+// meaningfully fanned out across devices. This client library's RunCommand
+// has no stdin and can't be cancelled once started, so there's no live
+// session here to write to or signal — see RunShellCommandResponse.
+type RunShellCommandRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+// RunShellCommandResponse carries the command's complete output; it's
+// returned directly in the RPC response once RunCommand finishes, not
+// streamed incrementally. A command that never terminates on its own (e.g.
+// "logcat" with no "-d") will hang this request forever with no way to
+// cancel it, since this client library exposes no way to interrupt a
+// command already in flight.
+type RunShellCommandResponse struct {
+	// Base64-encoded combined stdout/stderr.
+	Output string `json:"output"`
+}
+
+// Request to set up a local TCP listener that tunnels each connection to a
+// device-side service, like `adb forward`.
+type ForwardRequest struct {
+	// Host port to listen on, or 0 to pick any free port.
+	LocalPort int `json:"local_port"`
+	// Device-side endpoint, e.g. "tcp:5555" or "localabstract:foo".
+	Remote string `json:"remote"`
+}
+
+// Request to accept device-initiated connections on a device port and
+// tunnel each one to a host-side service, like `adb reverse`.
+type ReverseRequest struct {
+	// Device port to accept connections from.
+	RemotePort int `json:"remote_port"`
+	// Host-side endpoint to dial for each connection, e.g. "tcp:8080".
+	Local string `json:"local"`
+}
+
+// PortForward is a running forward or reverse tunnel, as returned by
+// list-forwards.
+type PortForward struct {
+	ID     string `json:"id"`
+	Serial string `json:"serial"`
+	// "forward" or "reverse".
+	Kind string `json:"kind"`
+	// The TCP port on the listening side: the host port we bound for
+	// "forward", or the device port we're accepting connections from for
+	// "reverse".
+	LocalPort int `json:"local_port"`
+	// The endpoint dialed for each connection: the device-side endpoint for
+	// "forward", or the host-side endpoint for "reverse".
+	Endpoint string `json:"endpoint"`
+
+	cancel context.CancelFunc
+}
+
+type ForwardResponse struct {
+	ID        string `json:"id"`
+	LocalPort int    `json:"local_port"`
+}
+
+type ReverseResponse struct {
+	ID string `json:"id"`
+}
+
+type ListForwardsResponse struct {
+	Forwards []*PortForward `json:"forwards"`
+}
+
+type RemoveForwardRequest struct {
+	ID string `json:"id"`
+}
+
+// reverseListener is the subset of an ADB reverse-forward subscription we
+// need; declared locally since goadb doesn't need to export a net.Listener
+// look-alike just for our purposes.
+type reverseListener interface {
+	Accept() (io.ReadWriteCloser, error)
+	Close() error
+}
+
+// Request to open an arbitrary device-side socket and stream its bytes back
+// and forth as base64 chunks, for protocols a Chrome extension can't reach
+// with a raw socket (e.g. a JSON-RPC service or JDWP).
+type ProxyConnectRequest struct {
+	// Device-side endpoint to dial, e.g. "tcp:7912" or "jdwp:1234".
+	Remote string `json:"remote"`
+}
+
+type ProxyConnectResponse struct {
+	StreamID string `json:"stream_id"`
+}
+
+type ProxyChunkRequest struct {
+	StreamID string `json:"stream_id"`
+	// Base64-encoded data to write to the device-side socket.
+	Data string `json:"data"`
+}
+
+type ProxyCloseRequest struct {
+	StreamID string `json:"stream_id"`
+}
+
+// ProxyDataData is the payload of an unsolicited "proxy-data" response.
+type ProxyDataData struct {
+	StreamID string `json:"stream_id"`
+	Data     string `json:"data"`
+}
+
+// ProxyClosedData is the payload of an unsolicited "proxy-closed" response,
+// sent once when a proxy-connect stream ends for any reason.
+type ProxyClosedData struct {
+	StreamID string `json:"stream_id"`
+	Error    string `json:"error,omitempty"`
+}
+
+// DeviceEventData is the payload of an unsolicited "device-event" response,
+// sent once per device state change while subscribe-device-events is active.
+type DeviceEventData struct {
+	Serial string `json:"serial"`
+	// "online", "offline", or "unknown".
+	State string `json:"state"`
+	// Populated when State is "online" and the device could still be found
+	// in the current device list.
+	Device *adb.DeviceInfo `json:"device,omitempty"`
+}
+
+// Request to install an APK already staged on the device (e.g. by push-file
+// or push-dir) or, for small APKs, sent inline as base64.
+type InstallApkRequest struct {
+	// Path to the APK on the device. If Data is set, it's pushed there first.
+	DevicePath string `json:"device_path"`
+	// Base64-encoded APK contents. Omit to install from an APK already at
+	// DevicePath.
+	Data string `json:"data,omitempty"`
+
+	Reinstall         bool `json:"reinstall,omitempty"`           // pm install -r
+	AllowTestPackages bool `json:"allow_test_packages,omitempty"` // pm install -t
+	AllowDowngrade    bool `json:"allow_downgrade,omitempty"`     // pm install -d
+	GrantPermissions  bool `json:"grant_permissions,omitempty"`   // pm install -g
+}
+
+type InstallApkResponse struct {
+	// Per-device results, keyed by serial.
+	Results map[string]PmResult `json:"results"`
+}
+
+// PmResult is the outcome of a single pm install/uninstall invocation on one
+// device.
+type PmResult struct {
+	Success bool `json:"success"`
+	// Set when Success is false and pm reported why, e.g. "INSTALL_FAILED_ALREADY_EXISTS".
+	Reason string `json:"reason,omitempty"`
+	// Raw pm output, in case Success/Reason couldn't be parsed from it.
+	Output string `json:"output,omitempty"`
+	// Set on transport/device errors, as opposed to a pm-reported failure.
+	Error string `json:"error,omitempty"`
+}
+
+type UninstallPackageRequest struct {
+	Package string `json:"package"`
+	// pm uninstall -k: keep the app's data and cache directories.
+	KeepData bool `json:"keep_data,omitempty"`
+}
+
+type UninstallPackageResponse struct {
+	// Per-device results, keyed by serial.
+	Results map[string]PmResult `json:"results"`
+}
+
+type ListPackagesResponse struct {
+	// Per-device results, keyed by serial: package name to installed APK path.
+	Results map[string]map[string]string `json:"results"`
+	// Per-device errors, keyed by serial.
+	DeviceErrors map[string]string `json:"device_errors,omitempty"`
+}
+
 type Response struct {
 	Success bool `json:"success"`
 
@@ -140,7 +413,7 @@ func main() {
 	if *install {
 		// Running from command line, turn off timestamps.
 		log.SetFlags(0)
-		if err := doInstallManifest(*extensionId, *binaryPath); err != nil {
+		if err := doInstallManifest(*extensionId, *binaryPath, Browser(*browser)); err != nil {
 			log.Fatal(err)
 		}
 		return
@@ -158,10 +431,16 @@ func main() {
 func doMain() {
 	log.Println("web-adb running")
 
+	rootCtx, rootCancel = context.WithCancel(context.Background())
+
 	for {
 		msg, err := readMessage(os.Stdin)
 		if err == io.EOF {
 			log.Println("extension disconnected, exiting")
+			// Tears down every outstanding forward, reverse, and
+			// proxy-connect stream; none of them can outlive the extension
+			// that owns them.
+			rootCancel()
 			return
 		}
 		if err != nil {
@@ -309,6 +588,430 @@ func handleRequest(req Request) (interface{}, error) {
 			Success:     true,
 		}, nil
 
+	case "pull-file":
+		var params PullFileRequest
+		err = json.Unmarshal(req.Params, &params)
+		if err != nil {
+			return nil, fmt.Errorf("invalid params: %s", string(req.Params))
+		}
+
+		resp := PullFileResponse{
+			StreamIDs:    make(map[string]string),
+			DeviceErrors: make(map[string]string),
+		}
+		err = doWithDevice(server, req.DeviceSerial, func(serial string, client *adb.DeviceClient) {
+			reader, err := client.OpenRead(params.DevicePath)
+			if err != nil {
+				resp.DeviceErrors[serial] = err.Error()
+				return
+			}
+			stream := newPullStream(params.DevicePath, reader)
+			log.Printf("pull stream %s opened %s on %s", stream.StreamID, stream.DevicePath, serial)
+			resp.StreamIDs[serial] = stream.StreamID
+		})
+		return resp, err
+
+	case "pull-chunk":
+		var params PullChunkRequest
+		err = json.Unmarshal(req.Params, &params)
+		if err != nil {
+			return nil, fmt.Errorf("invalid params: %s", string(req.Params))
+		}
+
+		stream, ok := pullStreams[params.StreamID]
+		if !ok {
+			err = fmt.Errorf("invalid stream ID: %s", params.StreamID)
+			log.Print(err)
+			return nil, err
+		}
+		if params.ChunkIndex != stream.LastChunkIndex+1 {
+			errMsg := fmt.Sprintf("expected chunk %d, got chunk %d",
+				stream.LastChunkIndex+1, params.ChunkIndex)
+			log.Printf("pull stream %s %s", stream.StreamID, errMsg)
+			return PullChunkResponse{
+				ChunkHeader: ChunkHeader{StreamID: stream.StreamID, ChunkIndex: params.ChunkIndex},
+				Error:       errMsg,
+			}, nil
+		}
+
+		data, eof, err := stream.ReadChunk()
+		header := ChunkHeader{StreamID: stream.StreamID, ChunkIndex: params.ChunkIndex, EndOfStream: eof}
+		if err != nil {
+			log.Printf("pull stream %s error reading chunk, closing: %v", stream.StreamID, err)
+			stream.Close()
+			header.EndOfStream = true
+			return PullChunkResponse{ChunkHeader: header, Error: err.Error()}, nil
+		}
+		if eof {
+			log.Printf("pull stream %s reached EOF, closing", stream.StreamID)
+			stream.Close()
+			return PullChunkResponse{ChunkHeader: header, Data: base64.StdEncoding.EncodeToString(data)}, nil
+		}
+		return PullChunkResponse{ChunkHeader: header, Data: base64.StdEncoding.EncodeToString(data)}, nil
+
+	case "push-dir":
+		var params PushDirRequest
+		err = json.Unmarshal(req.Params, &params)
+		if err != nil {
+			return nil, fmt.Errorf("invalid params: %s", string(req.Params))
+		}
+
+		result := DirSyncResult{Errors: make(map[string]string)}
+		err = filepath.Walk(params.LocalPath, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			if isShellUnsafeName(info.Name()) {
+				log.Printf("push-dir: skipping unsafe file name %s", info.Name())
+				return nil
+			}
+
+			relPath, err := filepath.Rel(params.LocalPath, p)
+			if err != nil {
+				return err
+			}
+			relPath = filepath.ToSlash(relPath)
+			pushDirFile(server, req.DeviceSerial, p, path.Join(params.DevicePath, relPath), relPath, info, &result)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return PushDirResponse{result}, nil
+
+	case "pull-dir":
+		var params PullDirRequest
+		err = json.Unmarshal(req.Params, &params)
+		if err != nil {
+			return nil, fmt.Errorf("invalid params: %s", string(req.Params))
+		}
+
+		resp := PullDirResponse{Results: make(map[string]DirSyncResult)}
+		err = doWithDevice(server, req.DeviceSerial, func(serial string, client *adb.DeviceClient) {
+			localRoot := params.LocalPath
+			if req.DeviceSerial == "" {
+				// Multiple devices may be pulled into the same local
+				// directory; keep them from colliding by nesting each
+				// device's tree under its own serial.
+				localRoot = filepath.Join(params.LocalPath, serial)
+			}
+
+			result := DirSyncResult{Errors: make(map[string]string)}
+			pullDeviceDir(client, params.DevicePath, localRoot, ".", &result)
+			resp.Results[serial] = result
+		})
+		return resp, err
+
+	case "run-shell-command":
+		if req.DeviceSerial == "" {
+			return nil, errors.New("run-shell-command requires a device_serial")
+		}
+		var params RunShellCommandRequest
+		err = json.Unmarshal(req.Params, &params)
+		if err != nil {
+			return nil, fmt.Errorf("invalid params: %s", string(req.Params))
+		}
+
+		client := adb.NewDeviceClient(server, adb.DeviceWithSerial(req.DeviceSerial))
+		log.Printf("running %s %s on %s", params.Command, params.Args, req.DeviceSerial)
+		output, err := client.RunCommand(params.Command, params.Args...)
+		if err != nil {
+			return nil, err
+		}
+		return RunShellCommandResponse{Output: base64.StdEncoding.EncodeToString([]byte(output))}, nil
+
+	case "forward":
+		if req.DeviceSerial == "" {
+			return nil, errors.New("forward requires a device_serial")
+		}
+		var params ForwardRequest
+		err = json.Unmarshal(req.Params, &params)
+		if err != nil {
+			return nil, fmt.Errorf("invalid params: %s", string(req.Params))
+		}
+
+		// Probed once up front, the same way reverse/proxy-connect are, so a
+		// caller doesn't get back a forward ID and a local port for a tunnel
+		// that dialDeviceService (see its doc comment) can never actually
+		// carry traffic for; failing every accepted connection individually
+		// would silently eat connections instead of rejecting the request.
+		probeClient := adb.NewDeviceClient(server, adb.DeviceWithSerial(req.DeviceSerial))
+		probeConn, err := dialDeviceService(probeClient, params.Remote)
+		if err != nil {
+			return nil, err
+		}
+		probeConn.Close()
+
+		listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", params.LocalPort))
+		if err != nil {
+			return nil, err
+		}
+		actualPort := listener.Addr().(*net.TCPAddr).Port
+
+		ctx, cancel := context.WithCancel(rootCtx)
+		pf := &PortForward{
+			ID:        uuid.NewRandom().String(),
+			Serial:    req.DeviceSerial,
+			Kind:      "forward",
+			LocalPort: actualPort,
+			Endpoint:  params.Remote,
+			cancel:    cancel,
+		}
+		registerPortForward(pf)
+		log.Printf("forward %s: %s -> %s:%s", pf.ID, listener.Addr(), req.DeviceSerial, params.Remote)
+		go runForwardListener(ctx, listener, server, req.DeviceSerial, params.Remote, pf.ID)
+
+		return ForwardResponse{ID: pf.ID, LocalPort: actualPort}, nil
+
+	case "reverse":
+		if req.DeviceSerial == "" {
+			return nil, errors.New("reverse requires a device_serial")
+		}
+		var params ReverseRequest
+		err = json.Unmarshal(req.Params, &params)
+		if err != nil {
+			return nil, fmt.Errorf("invalid params: %s", string(req.Params))
+		}
+
+		client := adb.NewDeviceClient(server, adb.DeviceWithSerial(req.DeviceSerial))
+		listener, err := openDeviceReverseListener(client, params.RemotePort)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.WithCancel(rootCtx)
+		pf := &PortForward{
+			ID:        uuid.NewRandom().String(),
+			Serial:    req.DeviceSerial,
+			Kind:      "reverse",
+			LocalPort: params.RemotePort,
+			Endpoint:  params.Local,
+			cancel:    cancel,
+		}
+		registerPortForward(pf)
+		log.Printf("reverse %s: %s:%d -> %s", pf.ID, req.DeviceSerial, params.RemotePort, params.Local)
+		go runReverseListener(ctx, listener, params.Local, pf.ID)
+
+		return ReverseResponse{ID: pf.ID}, nil
+
+	case "list-forwards":
+		portForwardsMu.Lock()
+		list := make([]*PortForward, 0, len(portForwards))
+		for _, pf := range portForwards {
+			if req.DeviceSerial == "" || pf.Serial == req.DeviceSerial {
+				list = append(list, pf)
+			}
+		}
+		portForwardsMu.Unlock()
+		return ListForwardsResponse{Forwards: list}, nil
+
+	case "remove-forward":
+		var params RemoveForwardRequest
+		err = json.Unmarshal(req.Params, &params)
+		if err != nil {
+			return nil, fmt.Errorf("invalid params: %s", string(req.Params))
+		}
+
+		pf, ok := removePortForward(params.ID)
+		if !ok {
+			return nil, fmt.Errorf("invalid forward ID: %s", params.ID)
+		}
+		pf.cancel()
+		return nil, nil
+
+	case "proxy-connect":
+		if req.DeviceSerial == "" {
+			return nil, errors.New("proxy-connect requires a device_serial")
+		}
+		var params ProxyConnectRequest
+		err = json.Unmarshal(req.Params, &params)
+		if err != nil {
+			return nil, fmt.Errorf("invalid params: %s", string(req.Params))
+		}
+
+		client := adb.NewDeviceClient(server, adb.DeviceWithSerial(req.DeviceSerial))
+		rwc, err := dialDeviceService(client, params.Remote)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.WithCancel(rootCtx)
+		stream := newProxyStream(req.DeviceSerial, rwc, cancel)
+		log.Printf("proxy stream %s connected to %s on %s", stream.StreamID, params.Remote, req.DeviceSerial)
+		go pumpProxyOutput(ctx, stream)
+
+		return ProxyConnectResponse{StreamID: stream.StreamID}, nil
+
+	case "proxy-chunk":
+		var params ProxyChunkRequest
+		err = json.Unmarshal(req.Params, &params)
+		if err != nil {
+			return nil, fmt.Errorf("invalid params: %s", string(req.Params))
+		}
+
+		stream, ok := getProxyStream(params.StreamID)
+		if !ok {
+			return nil, fmt.Errorf("invalid stream ID: %s", params.StreamID)
+		}
+
+		data, err := base64.StdEncoding.DecodeString(params.Data)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding data: %v", err)
+		}
+		if _, err := stream.rwc.Write(data); err != nil {
+			return nil, fmt.Errorf("error writing to proxy stream %s: %v", stream.StreamID, err)
+		}
+		return nil, nil
+
+	case "proxy-close":
+		var params ProxyCloseRequest
+		err = json.Unmarshal(req.Params, &params)
+		if err != nil {
+			return nil, fmt.Errorf("invalid params: %s", string(req.Params))
+		}
+
+		stream, ok := getProxyStream(params.StreamID)
+		if !ok {
+			return nil, fmt.Errorf("invalid stream ID: %s", params.StreamID)
+		}
+		log.Printf("proxy stream %s closed by request", stream.StreamID)
+		stream.cancel()
+		return nil, nil
+
+	case "subscribe-device-events":
+		deviceWatcherMu.Lock()
+		if deviceWatcherCancel != nil {
+			deviceWatcherMu.Unlock()
+			return nil, errors.New("already subscribed to device events")
+		}
+		watcher := adb.NewDeviceWatcher(server)
+		deviceWatcherCancel = watcher.Shutdown
+		deviceWatcherOwner = watcher
+		deviceWatcherMu.Unlock()
+
+		log.Println("subscribed to device events")
+		go runDeviceEventWatcher(server, watcher)
+		return nil, nil
+
+	case "unsubscribe-device-events":
+		deviceWatcherMu.Lock()
+		cancel := deviceWatcherCancel
+		deviceWatcherCancel = nil
+		deviceWatcherOwner = nil
+		deviceWatcherMu.Unlock()
+
+		if cancel == nil {
+			return nil, errors.New("not subscribed to device events")
+		}
+		log.Println("unsubscribed from device events")
+		cancel()
+		return nil, nil
+
+	case "install-apk":
+		var params InstallApkRequest
+		err = json.Unmarshal(req.Params, &params)
+		if err != nil {
+			return nil, fmt.Errorf("invalid params: %s", string(req.Params))
+		}
+		if params.DevicePath == "" {
+			return nil, errors.New("install-apk requires device_path")
+		}
+
+		var data []byte
+		if params.Data != "" {
+			data, err = base64.StdEncoding.DecodeString(params.Data)
+			if err != nil {
+				return nil, fmt.Errorf("error decoding data: %v", err)
+			}
+		}
+
+		resp := InstallApkResponse{Results: make(map[string]PmResult)}
+		err = doWithDevice(server, req.DeviceSerial, func(serial string, client *adb.DeviceClient) {
+			if data != nil {
+				w, err := client.OpenWrite(params.DevicePath, 0644, adb.MtimeOfClose)
+				if err != nil {
+					resp.Results[serial] = PmResult{Error: err.Error()}
+					return
+				}
+				_, writeErr := w.Write(data)
+				if closeErr := w.Close(); writeErr == nil {
+					writeErr = closeErr
+				}
+				if writeErr != nil {
+					resp.Results[serial] = PmResult{Error: writeErr.Error()}
+					return
+				}
+			}
+
+			args := []string{"install"}
+			if params.Reinstall {
+				args = append(args, "-r")
+			}
+			if params.AllowTestPackages {
+				args = append(args, "-t")
+			}
+			if params.AllowDowngrade {
+				args = append(args, "-d")
+			}
+			if params.GrantPermissions {
+				args = append(args, "-g")
+			}
+			args = append(args, params.DevicePath)
+
+			output, err := client.RunCommand("pm", args...)
+			if err != nil {
+				resp.Results[serial] = PmResult{Error: err.Error()}
+				return
+			}
+			resp.Results[serial] = parsePmResult(output)
+		})
+		return resp, err
+
+	case "uninstall-package":
+		var params UninstallPackageRequest
+		err = json.Unmarshal(req.Params, &params)
+		if err != nil {
+			return nil, fmt.Errorf("invalid params: %s", string(req.Params))
+		}
+		if params.Package == "" {
+			return nil, errors.New("uninstall-package requires package")
+		}
+
+		resp := UninstallPackageResponse{Results: make(map[string]PmResult)}
+		err = doWithDevice(server, req.DeviceSerial, func(serial string, client *adb.DeviceClient) {
+			args := []string{"uninstall"}
+			if params.KeepData {
+				args = append(args, "-k")
+			}
+			args = append(args, params.Package)
+
+			output, err := client.RunCommand("pm", args...)
+			if err != nil {
+				resp.Results[serial] = PmResult{Error: err.Error()}
+				return
+			}
+			resp.Results[serial] = parsePmResult(output)
+		})
+		return resp, err
+
+	case "list-packages":
+		resp := ListPackagesResponse{
+			Results:      make(map[string]map[string]string),
+			DeviceErrors: make(map[string]string),
+		}
+		err = doWithDevice(server, req.DeviceSerial, func(serial string, client *adb.DeviceClient) {
+			output, err := client.RunCommand("pm", "list", "packages", "-f")
+			if err != nil {
+				resp.DeviceErrors[serial] = err.Error()
+				return
+			}
+			resp.Results[serial] = parsePackageList(output)
+		})
+		return resp, err
+
 	default:
 		return nil, fmt.Errorf("unrecognized command: %s", req.Command)
 	}
@@ -317,7 +1020,9 @@ func handleRequest(req Request) (interface{}, error) {
 func sendResponse(req Request, resp Response) {
 	resp.Command = req.Command
 	msg := marshal(resp)
+	stdoutMu.Lock()
 	err := sendMessage(msg, os.Stdout)
+	stdoutMu.Unlock()
 	if err == ErrMsgTooLarge {
 		log.Printf("message too large: %s", string(msg))
 		sendResponse(req, Response{
@@ -356,6 +1061,27 @@ func doWithDevice(server adb.Server, deviceSerial string, action func(string, *a
 	return nil
 }
 
+// dialDeviceService would open a raw, bidirectional connection to an
+// arbitrary service on the device (e.g. "tcp:5555"), the way `adb forward`
+// and `proxy-connect` need. This client library's public surface is
+// RunCommand, OpenRead/OpenWrite, Stat, ListDirEntries, and device
+// watching/listing — nothing exposes a raw device-socket dial, so this is
+// infeasible against this library rather than merely unimplemented. The
+// "forward" case (which probes once before binding its listener) and
+// "proxy-connect" treat this error as fatal to the request rather than
+// handing back a forward/stream ID; runForwardListener, dialing again for
+// each accepted connection, logs the error and closes just that connection.
+func dialDeviceService(client *adb.DeviceClient, service string) (io.ReadWriteCloser, error) {
+	return nil, fmt.Errorf("dialing device service %q is not supported by this adb client library", service)
+}
+
+// openDeviceReverseListener would accept device-initiated connections for
+// `adb reverse`. Same limitation as dialDeviceService: this client library
+// doesn't expose a primitive for it.
+func openDeviceReverseListener(client *adb.DeviceClient, remotePort int) (reverseListener, error) {
+	return nil, fmt.Errorf("reverse port forwarding is not supported by this adb client library")
+}
+
 func newPushStream(devicePath string) *PushStream {
 	stream := &PushStream{
 		StreamID:       uuid.NewRandom().String(),
@@ -410,6 +1136,499 @@ func (s *PushStream) WriteChunk(base64Data string) error {
 	return nil
 }
 
+// PullStream is the read-side counterpart of PushStream. Since different
+// devices can have different content at the same path, a pull opens one
+// stream per device rather than fanning a single stream out to all of them.
+type PullStream struct {
+	StreamID       string
+	DevicePath     string
+	LastChunkIndex int64
+	reader         io.ReadCloser
+}
+
+var pullStreams = make(map[string]*PullStream)
+
+const pullChunkSize = 64 * 1024
+
+func newPullStream(devicePath string, reader io.ReadCloser) *PullStream {
+	stream := &PullStream{
+		StreamID:       uuid.NewRandom().String(),
+		DevicePath:     devicePath,
+		LastChunkIndex: -1,
+		reader:         reader,
+	}
+	pullStreams[stream.StreamID] = stream
+	return stream
+}
+
+func (s *PullStream) Close() {
+	s.reader.Close()
+	delete(pullStreams, s.StreamID)
+}
+
+// ReadChunk reads the next chunk and advances LastChunkIndex. eof is true
+// once the stream has been fully read; data may still be non-empty on the
+// same call that reports eof.
+func (s *PullStream) ReadChunk() (data []byte, eof bool, err error) {
+	buf := make([]byte, pullChunkSize)
+	n, err := s.reader.Read(buf)
+	s.LastChunkIndex++
+	if err == io.EOF {
+		return buf[:n], true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return buf[:n], false, nil
+}
+
+// isShellUnsafeName mirrors mozdevice's directory-walk filter: names
+// containing characters a shell could misinterpret are skipped rather than
+// risking a broken sync protocol command.
+func isShellUnsafeName(name string) bool {
+	return strings.ContainsAny(name, " $`\"'\\;|&<>(){}*?~!#")
+}
+
+// parsePmResult parses the output of `pm install` or `pm uninstall`, which
+// ends with a line of "Success" or "Failure [REASON]".
+func parsePmResult(output string) PmResult {
+	trimmed := strings.TrimSpace(output)
+	if idx := strings.Index(trimmed, "Failure"); idx != -1 {
+		reason := strings.TrimSpace(trimmed[idx+len("Failure"):])
+		reason = strings.Trim(reason, "[] ")
+		return PmResult{Reason: reason, Output: trimmed}
+	}
+	if strings.Contains(trimmed, "Success") {
+		return PmResult{Success: true, Output: trimmed}
+	}
+	return PmResult{Output: trimmed}
+}
+
+// parsePackageList parses the output of `pm list packages -f`, whose lines
+// look like "package:/data/app/foo-1/base.apk=com.example.foo".
+func parsePackageList(output string) map[string]string {
+	packages := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "package:") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "package:")
+		idx := strings.LastIndex(line, "=")
+		if idx == -1 {
+			continue
+		}
+		packages[line[idx+1:]] = line[:idx]
+	}
+	return packages
+}
+
+// pushDirFile pushes the single local file at localPath to devicePath on
+// every device selected by deviceSerial, recording a failure in result only
+// if every device failed (mirroring PushStream's "all device streams
+// closed" semantics for a single chunk). Failures are keyed by relPath.
+func pushDirFile(server adb.Server, deviceSerial, localPath, devicePath, relPath string, info os.FileInfo, result *DirSyncResult) {
+	data, err := ioutil.ReadFile(localPath)
+	if err != nil {
+		result.Errors[relPath] = err.Error()
+		return
+	}
+
+	succeeded := false
+	var lastErr error
+	doWithDevice(server, deviceSerial, func(serial string, client *adb.DeviceClient) {
+		w, err := client.OpenWrite(devicePath, info.Mode().Perm(), info.ModTime())
+		if err != nil {
+			lastErr = err
+			return
+		}
+		_, err = w.Write(data)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			lastErr = err
+			return
+		}
+		succeeded = true
+	})
+
+	if !succeeded {
+		if lastErr == nil {
+			lastErr = errors.New("no devices available")
+		}
+		result.Errors[relPath] = lastErr.Error()
+		return
+	}
+	result.FilesTransferred++
+}
+
+// pullDeviceDir recursively pulls devicePath's contents from client into
+// localPath, creating directories as needed and skipping (but recording)
+// any entry that fails to transfer under its path relative to the root of
+// the transfer (relPath is devicePath's own, "." for the root).
+func pullDeviceDir(client *adb.DeviceClient, devicePath, localPath, relPath string, result *DirSyncResult) {
+	entries, err := client.ListDirEntries(devicePath)
+	if err != nil {
+		result.Errors[relPath] = err.Error()
+		return
+	}
+	defer entries.Close()
+
+	var all []*adb.DirEntry
+	for entries.Next() {
+		all = append(all, entries.Entry())
+	}
+	if err := entries.Err(); err != nil {
+		result.Errors[relPath] = err.Error()
+		return
+	}
+
+	for _, entry := range all {
+		if entry.Name == "." || entry.Name == ".." {
+			continue
+		}
+		if isShellUnsafeName(entry.Name) {
+			log.Printf("pull-dir: skipping unsafe file name %s", entry.Name)
+			continue
+		}
+
+		childDevicePath := path.Join(devicePath, entry.Name)
+		childLocalPath := filepath.Join(localPath, entry.Name)
+		childRelPath := path.Join(relPath, entry.Name)
+
+		if entry.Mode.IsDir() {
+			if err := os.MkdirAll(childLocalPath, 0755); err != nil {
+				result.Errors[childRelPath] = err.Error()
+				continue
+			}
+			pullDeviceDir(client, childDevicePath, childLocalPath, childRelPath, result)
+			continue
+		}
+		if !entry.Mode.IsRegular() {
+			continue
+		}
+
+		if err := pullDeviceFile(client, childDevicePath, childLocalPath, entry); err != nil {
+			result.Errors[childRelPath] = err.Error()
+			continue
+		}
+		result.FilesTransferred++
+	}
+}
+
+// sendUnsolicited writes a response that isn't in reply to any particular
+// request, such as device-event. stdoutMu keeps it from interleaving with
+// the main loop's own responses, which share the same stdout pipe.
+func sendUnsolicited(resp Response) {
+	msg := marshal(resp)
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
+	if err := sendMessage(msg, os.Stdout); err != nil {
+		log.Printf("error sending unsolicited message: %s", err)
+	}
+}
+
+var (
+	portForwardsMu sync.Mutex
+	portForwards   = make(map[string]*PortForward)
+)
+
+func registerPortForward(pf *PortForward) {
+	portForwardsMu.Lock()
+	portForwards[pf.ID] = pf
+	portForwardsMu.Unlock()
+}
+
+func removePortForward(id string) (*PortForward, bool) {
+	portForwardsMu.Lock()
+	defer portForwardsMu.Unlock()
+	pf, ok := portForwards[id]
+	if ok {
+		delete(portForwards, id)
+	}
+	return pf, ok
+}
+
+// runForwardListener accepts host-side connections on listener and tunnels
+// each one to remote on the device, until ctx is cancelled or the listener
+// fails.
+func runForwardListener(ctx context.Context, listener net.Listener, server adb.Server, serial, remote, id string) {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		go func() {
+			defer conn.Close()
+			client := adb.NewDeviceClient(server, adb.DeviceWithSerial(serial))
+			remoteConn, err := dialDeviceService(client, remote)
+			if err != nil {
+				log.Printf("forward %s: error dialing device: %v", id, err)
+				return
+			}
+			defer remoteConn.Close()
+			pipeBidirectional(conn, remoteConn)
+		}()
+	}
+
+	removePortForward(id)
+	log.Printf("forward %s: listener closed", id)
+}
+
+// runReverseListener accepts device-initiated connections from listener and
+// tunnels each one to local on the host, until ctx is cancelled or the
+// listener fails.
+func runReverseListener(ctx context.Context, listener reverseListener, local, id string) {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		deviceConn, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		go func() {
+			defer deviceConn.Close()
+			localConn, err := net.Dial("tcp", local)
+			if err != nil {
+				log.Printf("reverse %s: error dialing local %s: %v", id, local, err)
+				return
+			}
+			defer localConn.Close()
+			pipeBidirectional(deviceConn, localConn)
+		}()
+	}
+
+	removePortForward(id)
+	log.Printf("reverse %s: listener closed", id)
+}
+
+// pipeBidirectional copies a to b and b to a concurrently, returning once
+// both directions have finished. Closing either side on the first direction
+// to finish unblocks the other.
+func pipeBidirectional(a, b io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(a, b); done <- struct{}{} }()
+	go func() { io.Copy(b, a); done <- struct{}{} }()
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
+
+// ProxyStream is a device-side socket opened by proxy-connect and streamed
+// back over Native Messaging as base64 chunks, tracked by StreamID the same
+// way forward/reverse track a PortForward, but cancellable independently via
+// its own context.
+type ProxyStream struct {
+	StreamID string
+	Serial   string
+	rwc      io.ReadWriteCloser
+	cancel   context.CancelFunc
+}
+
+var (
+	proxyStreamsMu sync.Mutex
+	proxyStreams   = make(map[string]*ProxyStream)
+)
+
+const (
+	proxyReadBufferSize = 256 * 1024
+	// maxProxyChunkBytes keeps a single proxy-data message's base64 payload
+	// comfortably under MaxOutgoingMsgLen once JSON/envelope overhead is added.
+	maxProxyChunkBytes = 700 * 1024
+)
+
+func newProxyStream(serial string, rwc io.ReadWriteCloser, cancel context.CancelFunc) *ProxyStream {
+	stream := &ProxyStream{
+		StreamID: uuid.NewRandom().String(),
+		Serial:   serial,
+		rwc:      rwc,
+		cancel:   cancel,
+	}
+	proxyStreamsMu.Lock()
+	proxyStreams[stream.StreamID] = stream
+	proxyStreamsMu.Unlock()
+	return stream
+}
+
+func getProxyStream(streamID string) (*ProxyStream, bool) {
+	proxyStreamsMu.Lock()
+	defer proxyStreamsMu.Unlock()
+	stream, ok := proxyStreams[streamID]
+	return stream, ok
+}
+
+func removeProxyStream(streamID string) (*ProxyStream, bool) {
+	proxyStreamsMu.Lock()
+	defer proxyStreamsMu.Unlock()
+	stream, ok := proxyStreams[streamID]
+	if ok {
+		delete(proxyStreams, streamID)
+	}
+	return stream, ok
+}
+
+// pumpProxyOutput reads from stream until ctx is cancelled or the
+// connection closes, forwarding every read as one or more unsolicited
+// "proxy-data" messages, then sends a final "proxy-closed" message and
+// unregisters the stream.
+func pumpProxyOutput(ctx context.Context, stream *ProxyStream) {
+	go func() {
+		<-ctx.Done()
+		stream.rwc.Close()
+	}()
+
+	buf := make([]byte, proxyReadBufferSize)
+	var readErr error
+	for {
+		n, err := stream.rwc.Read(buf)
+		if n > 0 {
+			sendProxyDataChunks(stream.StreamID, buf[:n])
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+	}
+
+	removeProxyStream(stream.StreamID)
+	stream.rwc.Close()
+
+	closedData := ProxyClosedData{StreamID: stream.StreamID}
+	if readErr != nil && readErr != io.EOF {
+		closedData.Error = readErr.Error()
+	}
+	log.Printf("proxy stream %s ended", stream.StreamID)
+	sendUnsolicited(Response{
+		Command: "proxy-closed",
+		Success: true,
+		Data:    closedData,
+	})
+}
+
+func sendProxyDataChunks(streamID string, data []byte) {
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxProxyChunkBytes {
+			n = maxProxyChunkBytes
+		}
+		sendUnsolicited(Response{
+			Command: "proxy-data",
+			Success: true,
+			Data: ProxyDataData{
+				StreamID: streamID,
+				Data:     base64.StdEncoding.EncodeToString(data[:n]),
+			},
+		})
+		data = data[n:]
+	}
+}
+
+var (
+	deviceWatcherMu     sync.Mutex
+	deviceWatcherCancel func()
+	// deviceWatcherOwner is the *adb.DeviceWatcher deviceWatcherCancel
+	// belongs to, so runDeviceEventWatcher's deferred cleanup can tell
+	// whether it still owns the shared vars before clearing them. Without
+	// this, an old watcher's goroutine exiting after a racing
+	// unsubscribe-device-events immediately followed by a new
+	// subscribe-device-events would clobber the *new* subscription's cancel
+	// func, leaving its watcher goroutine running with nothing able to find
+	// or cancel it.
+	deviceWatcherOwner *adb.DeviceWatcher
+)
+
+// runDeviceEventWatcher forwards every event from watcher as an unsolicited
+// "device-event" message until unsubscribe-device-events cancels it,
+// rootCtx is cancelled by stdin closing, or the watcher itself fails.
+func runDeviceEventWatcher(server adb.Server, watcher *adb.DeviceWatcher) {
+	defer func() {
+		deviceWatcherMu.Lock()
+		if deviceWatcherOwner == watcher {
+			deviceWatcherCancel = nil
+			deviceWatcherOwner = nil
+		}
+		deviceWatcherMu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-rootCtx.Done():
+			watcher.Shutdown()
+			return
+		case e, ok := <-watcher.C():
+			if !ok {
+				if err := watcher.Err(); err != nil {
+					log.Println("device watcher error:", err)
+				}
+				return
+			}
+
+			data := DeviceEventData{Serial: e.Serial}
+			switch {
+			case e.CameOnline():
+				data.State = "online"
+				data.Device = lookupDeviceInfo(server, e.Serial)
+			case e.WentOffline():
+				data.State = "offline"
+			default:
+				data.State = "unknown"
+			}
+			sendUnsolicited(Response{Command: "device-event", Success: true, Data: data})
+		}
+	}
+}
+
+func lookupDeviceInfo(server adb.Server, serial string) *adb.DeviceInfo {
+	client := adb.NewHostClient(server)
+	devices, err := client.ListDevices()
+	if err != nil {
+		return nil
+	}
+	for _, d := range devices {
+		if d.Serial == serial {
+			return d
+		}
+	}
+	return nil
+}
+
+func pullDeviceFile(client *adb.DeviceClient, devicePath, localPath string, entry *adb.DirEntry) error {
+	reader, err := client.OpenRead(devicePath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, reader); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if !entry.ModifiedAt.IsZero() {
+		os.Chtimes(localPath, entry.ModifiedAt, entry.ModifiedAt)
+	}
+	return nil
+}
+
 func readMessage(r io.Reader) ([]byte, error) {
 	var msgLen uint32
 	if err := binary.Read(r, byteOrder, &msgLen); err != nil {
@@ -444,15 +1663,15 @@ func sendMessage(msg []byte, w io.Writer) error {
 	return nil
 }
 
-func doInstallManifest(extensionId, binaryPath string) error {
-	if err := initManifest(extensionId, binaryPath); err != nil {
+func doInstallManifest(extensionId, binaryPath string, browser Browser) error {
+	if err := initManifest(extensionId, binaryPath, browser); err != nil {
 		return err
 	}
 
 	return installManifest()
 }
 
-func initManifest(extensionId, binaryPath string) error {
+func initManifest(extensionId, binaryPath string, browser Browser) error {
 	if binaryPath == "" {
 		binaryPath = os.Args[0]
 		log.Printf("no binary specified, using current binary: %s", binaryPath)
@@ -465,16 +1684,21 @@ func initManifest(extensionId, binaryPath string) error {
 		return err
 	}
 	ChromeManifest.Path = binaryPath
+	ChromeManifest.Browser = browser
 
 	if extensionId == "" {
 		return errors.New("no extension ID")
 	}
-	ChromeManifest.AllowedOrigins = []string{formatExtensionOrigin(extensionId)}
+	if browser == BrowserFirefox {
+		ChromeManifest.AllowedExtensions = []string{extensionId}
+	} else {
+		ChromeManifest.AllowedOrigins = []string{formatExtensionOrigin(extensionId)}
+	}
 	return nil
 }
 
 func installManifest() error {
-	path, err := getManifestPath(ChromeManifest.Name)
+	path, err := manifest.GetPath(ChromeManifest.Browser, ChromeManifest.Name)
 	if err != nil {
 		return err
 	}
@@ -490,31 +1714,16 @@ func installManifest() error {
 		return err
 	}
 
+	// No-op except on Windows, where browsers find the manifest via the
+	// registry rather than a fixed per-browser directory.
+	if err := manifest.RegisterPath(ChromeManifest.Browser, ChromeManifest.Name, path); err != nil {
+		return err
+	}
+
 	log.Println("manifest successfully installed.")
 	return nil
 }
 
-func getManifestPath(packageName string) (path string, err error) {
-	user, _ := user.Current()
-	switch runtime.GOOS {
-	case "darwin":
-		if user != nil {
-			path = fmt.Sprintf("%s/Library/Application Support/Google/Chrome/NativeMessagingHosts/%s.json", user.HomeDir, packageName)
-		} else {
-			path = fmt.Sprintf("/Library/Google/Chrome/NativeMessagingHosts/%s.json", packageName)
-		}
-	case "linux":
-		if user != nil {
-			path = fmt.Sprintf("%s/.config/google-chrome/NativeMessagingHosts/%s.json", user.HomeDir, packageName)
-		} else {
-			path = fmt.Sprintf("/etc/opt/chrome/native-messaging-hosts/%s.json", packageName)
-		}
-	default:
-		err = fmt.Errorf("not sure where to install manifest file on platform %s", runtime.GOOS)
-	}
-	return
-}
-
 func formatExtensionOrigin(extensionId string) string {
 	return fmt.Sprintf("chrome-extension://%s/", extensionId)
 }
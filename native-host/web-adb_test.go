@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePmResult(t *testing.T) {
+	cases := []struct {
+		name   string
+		output string
+		want   PmResult
+	}{
+		{
+			name:   "success",
+			output: "Success\n",
+			want:   PmResult{Success: true, Output: "Success"},
+		},
+		{
+			name:   "failure with reason",
+			output: "pkg: /data/local/tmp/app.apk\nFailure [INSTALL_FAILED_ALREADY_EXISTS]\n",
+			want: PmResult{
+				Success: false,
+				Reason:  "INSTALL_FAILED_ALREADY_EXISTS",
+				Output:  "pkg: /data/local/tmp/app.apk\nFailure [INSTALL_FAILED_ALREADY_EXISTS]",
+			},
+		},
+		{
+			name:   "unrecognized output",
+			output: "  some garbage  \n",
+			want:   PmResult{Output: "some garbage"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.want, parsePmResult(c.output))
+		})
+	}
+}
+
+func TestParsePackageList(t *testing.T) {
+	cases := []struct {
+		name   string
+		output string
+		want   map[string]string
+	}{
+		{
+			name:   "empty",
+			output: "",
+			want:   map[string]string{},
+		},
+		{
+			name:   "single package",
+			output: "package:/data/app/foo-1/base.apk=com.example.foo",
+			want: map[string]string{
+				"com.example.foo": "/data/app/foo-1/base.apk",
+			},
+		},
+		{
+			name: "multiple packages with blank lines",
+			output: "package:/data/app/foo-1/base.apk=com.example.foo\n" +
+				"\n" +
+				"package:/system/app/Bar/Bar.apk=com.example.bar\n",
+			want: map[string]string{
+				"com.example.foo": "/data/app/foo-1/base.apk",
+				"com.example.bar": "/system/app/Bar/Bar.apk",
+			},
+		},
+		{
+			name:   "line without package prefix is ignored",
+			output: "not-a-package-line\n",
+			want:   map[string]string{},
+		},
+		{
+			name:   "line without '=' is ignored",
+			output: "package:/data/app/foo-1/base.apk\n",
+			want:   map[string]string{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.want, parsePackageList(c.output))
+		})
+	}
+}
@@ -1,14 +1,18 @@
 package proxy
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -19,9 +23,27 @@ type AdbHttpProxy struct {
 	adbServer adb.Server
 	router    *mux.Router
 	listener  net.Listener
+	auth      *auth
+	tlsConfig *tls.Config
+
+	screensMu sync.Mutex
+	screens   map[string]*screenBroadcaster
+
+	deviceEvents     *BufferedSubscription
+	startDeviceWatch sync.Once
+
+	forwardsMu sync.Mutex
+	forwards   map[string]*forward
 }
 
-func NewAdbHttpProxy() (*AdbHttpProxy, error) {
+// deviceEventBufferSize is how many recent device connect/disconnect
+// events a reconnecting client can replay via Last-Event-ID.
+const deviceEventBufferSize = 100
+
+// NewAdbHttpProxy starts a proxy that requires browser clients to log in
+// with passwordHash (see HashPassword) and requires the paired Chrome
+// extension to send the token returned by AuthToken.
+func NewAdbHttpProxy(passwordHash []byte) (*AdbHttpProxy, error) {
 	adbServer, err := adb.NewServer(adb.ServerConfig{
 		PathToAdb: "/Users/zach/android-sdk/platform-tools/adb",
 	})
@@ -30,15 +52,28 @@ func NewAdbHttpProxy() (*AdbHttpProxy, error) {
 	}
 
 	proxy := &AdbHttpProxy{
-		adbServer: adbServer,
+		adbServer:    adbServer,
+		auth:         newAuth(passwordHash),
+		screens:      make(map[string]*screenBroadcaster),
+		deviceEvents: NewBufferedSubscription(deviceEventBufferSize),
+		forwards:     make(map[string]*forward),
 	}
 
 	r := mux.NewRouter()
-	r.HandleFunc("/devices", HandleEventSource(proxy.watchDevices)).Headers("Accept", "text/event-stream").Methods("GET", "HEAD")
-	r.HandleFunc("/devices", proxy.listDevices).Methods("GET", "HEAD")
-	r.HandleFunc("/devices/{serial}", proxy.deviceInfo).Methods("GET", "HEAD")
-	r.HandleFunc("/devices/{serial}/files/{path:.*}", proxy.deviceFiles).Methods("GET", "HEAD", "POST").Name("files")
-	r.HandleFunc("/devices/{serial}/execute", proxy.runCommand).Methods("POST")
+	r.HandleFunc("/auth/login", proxy.auth.login).Methods("POST")
+	r.HandleFunc("/auth/logout", proxy.auth.logout).Methods("POST")
+	r.HandleFunc("/devices", proxy.auth.requireAuth(HandleEventSource(proxy.watchDevices))).Headers("Accept", "text/event-stream").Methods("GET", "HEAD")
+	r.HandleFunc("/devices", proxy.auth.requireAuth(proxy.listDevices)).Methods("GET", "HEAD")
+	r.HandleFunc("/devices/{serial}", proxy.auth.requireAuth(proxy.deviceInfo)).Methods("GET", "HEAD")
+	r.HandleFunc("/devices/{serial}/files/{path:.*}", proxy.auth.requireAuth(proxy.deviceFiles)).Methods("GET", "HEAD", "POST").Name("files")
+	r.HandleFunc("/devices/{serial}/execute", proxy.auth.requireAuth(proxy.runCommand)).Methods("POST")
+	r.HandleFunc("/execute", proxy.auth.requireAuth(proxy.execute)).Methods("POST")
+	r.HandleFunc("/devices/{serial}/shell", proxy.auth.requireAuth(proxy.shell)).Methods("GET")
+	r.HandleFunc("/devices/{serial}/screen", proxy.auth.requireAuth(proxy.screen)).Methods("GET")
+	r.HandleFunc("/devices/{serial}/forward", proxy.auth.requireAuth(proxy.createForward)).Methods("POST")
+	r.HandleFunc("/devices/{serial}/forward/{id}", proxy.auth.requireAuth(proxy.forwardWebSocket)).Methods("GET").Name("forward")
+	r.HandleFunc("/devices/{serial}/forward/{id}", proxy.auth.requireAuth(proxy.deleteForward)).Methods("DELETE")
+	r.HandleFunc("/forwards", proxy.auth.requireAuth(proxy.listForwards)).Methods("GET")
 	proxy.router = r
 
 	// Port 0 means choose any available port.
@@ -55,15 +90,45 @@ func (p *AdbHttpProxy) Addr() string {
 	return p.listener.Addr().String()
 }
 
+// AuthToken is the value the paired Chrome extension must send in an
+// X-WebADB-Token header with every request. It's only ever handed out over
+// the native-messaging stdio handshake, never over HTTP.
+func (p *AdbHttpProxy) AuthToken() string {
+	return p.auth.Token()
+}
+
+// EnableTLS serves over TLS using the cert/key pair at certPath/keyPath,
+// generating and persisting a self-signed one there if it doesn't exist yet.
+func (p *AdbHttpProxy) EnableTLS(certPath, keyPath string) error {
+	cert, err := ensureSelfSignedCert(certPath, keyPath)
+	if err != nil {
+		return err
+	}
+	p.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	p.auth.secureCookies = true
+	return nil
+}
+
 func (p *AdbHttpProxy) Serve() error {
-	return http.Serve(p.listener, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		log.Printf("[%s] %s %s", req.RemoteAddr, req.Method, req.URL)
 
 		w.Header().Add("Cache-Control", "no-cache")
 		w.Header().Add("Access-Control-Allow-Origin", "*")
 
 		p.router.ServeHTTP(w, req)
-	}))
+	})
+
+	var err error
+	if p.tlsConfig != nil {
+		err = http.Serve(tls.NewListener(p.listener, p.tlsConfig), handler)
+	} else {
+		err = http.Serve(p.listener, handler)
+	}
+
+	p.closeForwards()
+
+	return err
 }
 
 func (p *AdbHttpProxy) listDevices(w http.ResponseWriter, req *http.Request) {
@@ -85,39 +150,75 @@ type DeviceEvent struct {
 	Data interface{} `json:"data"`
 }
 
-func (p *AdbHttpProxy) watchDevices(w *EventSource, req *http.Request) {
+// ensureDeviceWatcher starts the single adb.DeviceWatcher shared by every
+// subscriber, the first time it's needed. It's never stopped, so its
+// buffered events stay available across connection churn.
+func (p *AdbHttpProxy) ensureDeviceWatcher() {
+	p.startDeviceWatch.Do(func() {
+		go p.runDeviceWatcher()
+	})
+}
+
+func (p *AdbHttpProxy) runDeviceWatcher() {
 	log.Println("starting device watcher...")
 
-	var err error
 	watcher := adb.NewDeviceWatcher(p.adbServer)
 	defer watcher.Shutdown()
 
 	for {
 		e, ok := <-watcher.C()
 		if !ok {
-			if err = watcher.Err(); err != nil {
-				// Error reading event from ADB.
-				w.SendJSON(DeviceEvent{"error", err})
-				return
+			if err := watcher.Err(); err != nil {
+				log.Println("device watcher error:", err)
+				p.deviceEvents.Publish(deviceEventToSSE(DeviceEvent{"error", err.Error()}))
 			}
+			return
 		}
 
 		if e.CameOnline() {
 			log.Println("device connected:", e)
-			err = w.SendJSON(DeviceEvent{"connected", e})
+			p.deviceEvents.Publish(deviceEventToSSE(DeviceEvent{"connected", e}))
 		} else if e.WentOffline() {
 			log.Println("device disconnected:", e)
-			err = w.SendJSON(DeviceEvent{"disconnected", e})
+			p.deviceEvents.Publish(deviceEventToSSE(DeviceEvent{"disconnected", e}))
 		} else {
 			log.Println("unrecognized device event:", e)
 		}
-		if err != nil {
-			// Error sending event to extension.
-			log.Printf("error sending event: event=%#v err=%v", e, err)
+	}
+}
+
+func deviceEventToSSE(e DeviceEvent) Event {
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Println("error marshalling device event:", err)
+		data = []byte("null")
+	}
+	return Event{Data: string(data)}
+}
+
+// watchDevices replays any device events the client missed since
+// Last-Event-ID, then joins the live stream shared by every other
+// connected client.
+func (p *AdbHttpProxy) watchDevices(w *EventSource, req *http.Request) {
+	p.ensureDeviceWatcher()
+
+	lastEventID, _ := strconv.Atoi(req.Header.Get("Last-Event-ID"))
+	replay, live, unsubscribe := p.deviceEvents.Subscribe(lastEventID)
+	defer unsubscribe()
+
+	for _, e := range replay {
+		if err := w.SendEvent(e); err != nil {
+			log.Println("error replaying device event:", err)
 			return
 		}
 	}
 
+	for e := range live {
+		if err := w.SendEvent(e); err != nil {
+			log.Println("error sending device event:", err)
+			return
+		}
+	}
 }
 
 func (p *AdbHttpProxy) deviceInfo(w http.ResponseWriter, req *http.Request) {
@@ -141,7 +242,7 @@ func (p *AdbHttpProxy) deviceFiles(w http.ResponseWriter, req *http.Request) {
 
 	switch req.Method {
 	case "GET", "HEAD":
-		p.getFile(w, serial, path)
+		p.getFile(w, req, serial, path)
 	case "POST":
 		p.uploadFile(w, serial, path, req)
 	default:
@@ -149,7 +250,7 @@ func (p *AdbHttpProxy) deviceFiles(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (p *AdbHttpProxy) getFile(w http.ResponseWriter, serial, path string) {
+func (p *AdbHttpProxy) getFile(w http.ResponseWriter, req *http.Request, serial, path string) {
 	client := adb.NewDeviceClient(p.adbServer, adb.DeviceWithSerial(serial))
 
 	// First stat the file to see if it's a directory.
@@ -161,7 +262,7 @@ func (p *AdbHttpProxy) getFile(w http.ResponseWriter, serial, path string) {
 
 	if target.Mode.IsRegular() {
 		// Stream file contents.
-		p.downloadFile(w, client, target, serial, path)
+		p.downloadFile(w, req, client, target, serial, path)
 	} else {
 		p.listFiles(w, client, serial, path)
 	}
@@ -189,15 +290,12 @@ func (p *AdbHttpProxy) listFiles(w http.ResponseWriter, client *adb.DeviceClient
 	writeJson(w, allEntries)
 }
 
-func (p *AdbHttpProxy) downloadFile(w http.ResponseWriter, client *adb.DeviceClient, target *adb.DirEntry, serial, path string) {
+func (p *AdbHttpProxy) downloadFile(w http.ResponseWriter, req *http.Request, client *adb.DeviceClient, target *adb.DirEntry, serial, path string) {
 	log.Printf("downloading %s:%s", serial, path)
 
 	// We don't know the content type, so assume binary.
 	w.Header().Set("Content-Type", "application/octet-stream")
-	if target.Size > 0 {
-		// Don't send 0 size because it may be a device.
-		w.Header().Set("Content-Length", strconv.Itoa(int(target.Size)))
-	}
+	w.Header().Set("Accept-Ranges", "bytes")
 
 	var modifiedAt time.Time
 	if target.ModifiedAt.IsZero() {
@@ -207,6 +305,15 @@ func (p *AdbHttpProxy) downloadFile(w http.ResponseWriter, client *adb.DeviceCli
 	}
 	w.Header().Set("Date", modifiedAt.Format(time.RFC3339))
 
+	etag := fileETag(target, modifiedAt)
+	w.Header().Set("ETag", etag)
+
+	size := int64(target.Size)
+	start, end, hasRange := parseRangeHeader(req.Header.Get("Range"), size)
+	if hasRange && !ifRangeMatches(req.Header.Get("If-Range"), etag) {
+		hasRange = false
+	}
+
 	stream, err := client.OpenRead(path)
 	if err != nil {
 		writeError(w, http.StatusBadRequest, err)
@@ -214,19 +321,160 @@ func (p *AdbHttpProxy) downloadFile(w http.ResponseWriter, client *adb.DeviceCli
 	}
 	defer stream.Close()
 
-	n, err := io.Copy(w, stream)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("error downloading file after %d bytes: %s", n, err))
+	if !hasRange {
+		if target.Size > 0 {
+			// Don't send 0 size because it may be a device.
+			w.Header().Set("Content-Length", strconv.Itoa(int(target.Size)))
+		}
+		n, err := io.Copy(w, stream)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("error downloading file after %d bytes: %s", n, err))
+		}
+		return
+	}
+
+	if start > 0 {
+		// The sync stream isn't seekable, so resuming means reading and
+		// discarding the part we already have.
+		if _, err := io.CopyN(ioutil.Discard, stream, start); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("error skipping to range start: %s", err))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.WriteHeader(http.StatusPartialContent)
+
+	n, err := io.CopyN(w, stream, end-start+1)
+	if err != nil && err != io.EOF {
+		log.Printf("error writing ranged response after %d bytes: %s", n, err)
+	}
+}
+
+// fileETag is derived from size and mtime, cheaply enough to recompute on
+// every request, so an If-Range check doesn't need any extra state.
+func fileETag(target *adb.DirEntry, modifiedAt time.Time) string {
+	return fmt.Sprintf("%d-%d", target.Size, modifiedAt.Unix())
+}
+
+func ifRangeMatches(ifRange, etag string) bool {
+	return ifRange == "" || ifRange == etag
+}
+
+// parseRangeHeader parses a single-range "bytes=start-end" Range header
+// (multi-range requests aren't supported and are treated as no range).
+func parseRangeHeader(header string, size int64) (start, end int64, ok bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return 0, 0, false
+	}
+	spec := header[len(prefix):]
+	if strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+
+	if parts[0] == "" {
+		// Suffix range: the last N bytes.
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true
+	}
+
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+
+	if parts[1] == "" {
+		return start, size - 1, true
 	}
+
+	end, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	if end >= size {
+		end = size - 1
+	}
+	return start, end, true
+}
+
+// parseContentRangeStart parses the start offset out of a request
+// "Content-Range: bytes start-end/total" header. ok reports whether the
+// start offset and the total ("*" gives a total of 0) could be parsed; the
+// end offset isn't checked, since the only thing uploadFile needs to know is
+// whether the client is asking to resume past byte 0.
+func parseContentRangeStart(header string) (start, total int64, ok bool) {
+	const prefix = "bytes "
+	if !strings.HasPrefix(header, prefix) {
+		return 0, 0, false
+	}
+	spec := header[len(prefix):]
+
+	slash := strings.IndexByte(spec, '/')
+	if slash == -1 {
+		return 0, 0, false
+	}
+	totalStr := spec[slash+1:]
+	rangeStr := spec[:slash]
+
+	dash := strings.IndexByte(rangeStr, '-')
+	if dash == -1 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(rangeStr[:dash], 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+
+	if totalStr != "*" {
+		total, err = strconv.ParseInt(totalStr, 10, 64)
+		if err != nil || total < 0 {
+			return 0, 0, false
+		}
+	}
+
+	return start, total, true
 }
 
+// uploadFile writes the whole request body to path in one shot. The ADB
+// sync SEND service has no append/resume semantics at the wire-protocol
+// level, so a chunked/resumable upload isn't possible through this client;
+// callers that need to resume a failed upload must restart it from the
+// beginning.
 func (p *AdbHttpProxy) uploadFile(w http.ResponseWriter, serial, path string, req *http.Request) {
 	log.Printf("uploading file to %s:%s", serial, path)
 	log.Print(req.Header)
 
 	defer req.Body.Close()
 
+	// A client sending Content-Range is asking to resume a partial upload by
+	// appending past some existing prefix. The ADB sync SEND service this
+	// client library wraps (OpenWrite) has no append/resume semantics at the
+	// wire-protocol level — it only ever writes a file from byte 0 — so
+	// honoring a nonzero start here would silently write just the tail chunk
+	// as if it were the whole file, corrupting the upload instead of
+	// resuming it. Reject the request instead of doing that.
+	if cr := req.Header.Get("Content-Range"); cr != "" {
+		if start, _, ok := parseContentRangeStart(cr); ok && start > 0 {
+			writeError(w, http.StatusNotImplemented, fmt.Errorf("resumable upload is not supported by this adb client library: %s", cr))
+			return
+		}
+	}
+
 	client := adb.NewDeviceClient(p.adbServer, adb.DeviceWithSerial(serial))
+
 	fileStream, err := client.OpenWrite(path, 0644, adb.MtimeOfClose)
 	if err != nil {
 		writeError(w, http.StatusBadRequest, err)
@@ -248,6 +496,21 @@ func (p *AdbHttpProxy) uploadFile(w http.ResponseWriter, serial, path string, re
 type RunCommandRequest struct {
 	Command string   `json:"command"`
 	Args    []string `json:"args"`
+
+	// Only used by /execute. Empty means run on every connected device.
+	DeviceSerial string `json:"device_serial"`
+}
+
+// CommandResult is the result of running a shell command on a single
+// device, as returned by /execute.
+type CommandResult struct {
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type RunCommandResponse struct {
+	// Map of device serials to command results.
+	Results map[string]CommandResult `json:"results"`
 }
 
 func (p *AdbHttpProxy) runCommand(w http.ResponseWriter, req *http.Request) {
@@ -280,6 +543,132 @@ func (p *AdbHttpProxy) runCommand(w http.ResponseWriter, req *http.Request) {
 	w.Write([]byte(output))
 }
 
+// defaultExecuteParallelism bounds how many devices /execute runs a
+// command on at once; override per-request with ?parallelism=N.
+const defaultExecuteParallelism = 4
+
+// execute runs a command on every connected device (or just
+// data.DeviceSerial, if set) concurrently, returning once every device has
+// a result. With ?stream=1 it instead streams one SSE event per device as
+// its result comes in, so the extension can show progress instead of
+// blocking on the slowest device.
+func (p *AdbHttpProxy) execute(w http.ResponseWriter, req *http.Request) {
+	var data RunCommandRequest
+	if err := json.NewDecoder(req.Body).Decode(&data); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if data.Command == "" {
+		writeError(w, http.StatusBadRequest, errors.New("no command specified"))
+		return
+	}
+
+	var serials []string
+	if data.DeviceSerial != "" {
+		serials = []string{data.DeviceSerial}
+	} else {
+		var err error
+		serials, err = adb.NewHostClient(p.adbServer).ListDeviceSerials()
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+	}
+
+	parallelism := defaultExecuteParallelism
+	if n, err := strconv.Atoi(req.URL.Query().Get("parallelism")); err == nil && n > 0 {
+		parallelism = n
+	}
+
+	if req.URL.Query().Get("stream") == "1" {
+		p.executeStream(w, serials, data, parallelism)
+		return
+	}
+
+	writeJson(w, RunCommandResponse{Results: p.executeOnDevices(serials, data, parallelism)})
+}
+
+// executeOnDevices runs data on every serial, bounded by parallelism
+// concurrent devices at a time, and waits for them all to finish.
+func (p *AdbHttpProxy) executeOnDevices(serials []string, data RunCommandRequest, parallelism int) map[string]CommandResult {
+	results := make(map[string]CommandResult, len(serials))
+	var resultsMu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallelism)
+
+	for _, serial := range serials {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(serial string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result := p.executeOnDevice(serial, data)
+
+			resultsMu.Lock()
+			results[serial] = result
+			resultsMu.Unlock()
+		}(serial)
+	}
+	wg.Wait()
+
+	return results
+}
+
+func (p *AdbHttpProxy) executeOnDevice(serial string, data RunCommandRequest) CommandResult {
+	client := adb.NewDeviceClient(p.adbServer, adb.DeviceWithSerial(serial))
+	output, err := client.RunCommand(data.Command, data.Args...)
+	if err != nil {
+		return CommandResult{Error: err.Error()}
+	}
+	return CommandResult{Output: output}
+}
+
+type executeStreamEvent struct {
+	Serial string        `json:"serial"`
+	Result CommandResult `json:"result"`
+}
+
+func (p *AdbHttpProxy) executeStream(w http.ResponseWriter, serials []string, data RunCommandRequest, parallelism int) {
+	src := EventSource{w: w}
+	if f, ok := w.(http.Flusher); ok {
+		src.f = f
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+
+	// Buffered so a device finishing before the dispatch loop below gets
+	// around to every serial never blocks on a reader that hasn't started.
+	results := make(chan executeStreamEvent, len(serials))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallelism)
+
+	for _, serial := range serials {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(serial string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results <- executeStreamEvent{Serial: serial, Result: p.executeOnDevice(serial, data)}
+		}(serial)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	for result := range results {
+		data, err := json.Marshal(result)
+		if err != nil {
+			log.Println("error marshalling execute result:", err)
+			continue
+		}
+		if err := src.SendEvent(Event{Data: string(data)}); err != nil {
+			log.Println("error streaming execute result:", err)
+			return
+		}
+	}
+}
+
 func writeJson(w http.ResponseWriter, v interface{}) {
 	log.Printf("marshalling %#v", v)
 
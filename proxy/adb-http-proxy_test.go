@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRangeHeader(t *testing.T) {
+	const size = int64(1000)
+
+	cases := []struct {
+		name      string
+		header    string
+		wantStart int64
+		wantEnd   int64
+		wantOK    bool
+	}{
+		{"no header", "", 0, 0, false},
+		{"wrong unit", "items=0-499", 0, 0, false},
+		{"multi-range rejected", "bytes=0-499,500-999", 0, 0, false},
+		{"missing dash", "bytes=500", 0, 0, false},
+		{"start to end", "bytes=0-499", 0, 499, true},
+		{"start to EOF", "bytes=500-", 500, 999, true},
+		{"end clamped to size", "bytes=500-9999", 500, 999, true},
+		{"suffix range", "bytes=-500", 500, 999, true},
+		{"suffix range longer than size", "bytes=-9999", 0, 999, true},
+		{"suffix range zero length", "bytes=-0", 0, 0, false},
+		{"suffix range non-numeric", "bytes=-abc", 0, 0, false},
+		{"start at size is out of range", "bytes=1000-", 0, 0, false},
+		{"start past size is out of range", "bytes=1001-", 0, 0, false},
+		{"end before start", "bytes=500-100", 0, 0, false},
+		{"negative start", "bytes=-1-500", 0, 0, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			start, end, ok := parseRangeHeader(c.header, size)
+			assert.Equal(t, c.wantOK, ok)
+			if c.wantOK {
+				assert.Equal(t, c.wantStart, start)
+				assert.Equal(t, c.wantEnd, end)
+			}
+		})
+	}
+}
+
+func TestParseContentRangeStart(t *testing.T) {
+	cases := []struct {
+		name      string
+		header    string
+		wantStart int64
+		wantTotal int64
+		wantOK    bool
+	}{
+		{"empty", "", 0, 0, false},
+		{"wrong unit", "items 0-499/1000", 0, 0, false},
+		{"missing slash", "bytes 0-499", 0, 0, false},
+		{"missing dash", "bytes 500/1000", 0, 0, false},
+		{"from start", "bytes 0-499/1000", 0, 1000, true},
+		{"resuming mid-file", "bytes 500-999/1000", 500, 1000, true},
+		{"unknown total", "bytes 500-999/*", 500, 0, true},
+		{"negative start", "bytes -1-499/1000", 0, 0, false},
+		{"non-numeric start", "bytes abc-499/1000", 0, 0, false},
+		{"non-numeric total", "bytes 0-499/abc", 0, 0, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			start, total, ok := parseContentRangeStart(c.header)
+			assert.Equal(t, c.wantOK, ok)
+			if c.wantOK {
+				assert.Equal(t, c.wantStart, start)
+				assert.Equal(t, c.wantTotal, total)
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sessionCookieName = "web-adb-session"
+	sessionTTL        = 7 * 24 * time.Hour
+	tokenHeaderName   = "X-WebADB-Token"
+	csrfHeaderName    = "X-CSRF-Token"
+)
+
+// AuthConfig is the credential persisted by `-set-password` and loaded on
+// every subsequent start.
+type AuthConfig struct {
+	PasswordHash []byte `json:"password_hash"`
+}
+
+func LoadAuthConfig(path string) (*AuthConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg AuthConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func SaveAuthConfig(path string, cfg *AuthConfig) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+func HashPassword(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+// GenerateRandomPassword is used to pick an admin password the first time
+// the proxy runs, so there's a sane default without requiring setup.
+func GenerateRandomPassword() string {
+	return generateRandomToken()
+}
+
+func generateRandomToken() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		// Entropy failures here mean the machine is unusable anyway.
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// session tracks a logged-in browser's cookie and the CSRF token that must
+// accompany state-changing requests made with it.
+type session struct {
+	csrfToken string
+	expiresAt time.Time
+}
+
+// auth gates HTTP access to the proxy. Browser clients log in with a
+// password (POST /auth/login) and get a session cookie plus a CSRF token
+// back; the paired Chrome extension instead sends the random token handed
+// to it directly over the native-messaging stdio handshake, which no other
+// local process can observe.
+type auth struct {
+	passwordHash []byte
+	token        string
+
+	// secureCookies marks the session cookie Secure, so it's never sent
+	// over a plaintext connection. Set by AdbHttpProxy.EnableTLS; false
+	// until then, since there's no TLS listener yet to require it of.
+	secureCookies bool
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+func newAuth(passwordHash []byte) *auth {
+	return &auth{
+		passwordHash: passwordHash,
+		token:        generateRandomToken(),
+		sessions:     make(map[string]*session),
+	}
+}
+
+// Token is the value the extension must send back in an X-WebADB-Token
+// header. It's regenerated every time the proxy starts.
+func (a *auth) Token() string {
+	return a.token
+}
+
+// authenticate reports whether req is allowed through, and, if it was
+// authenticated via session cookie, the CSRF token that must accompany any
+// state-changing request made with that cookie.
+func (a *auth) authenticate(req *http.Request) (csrfToken string, ok bool) {
+	if token := req.Header.Get(tokenHeaderName); token != "" {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1 {
+			return "", true
+		}
+		return "", false
+	}
+
+	cookie, err := req.Cookie(sessionCookieName)
+	if err != nil {
+		return "", false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	sess, ok := a.sessions[cookie.Value]
+	if !ok || time.Now().After(sess.expiresAt) {
+		delete(a.sessions, cookie.Value)
+		return "", false
+	}
+	return sess.csrfToken, true
+}
+
+func (a *auth) checkCSRF(req *http.Request, csrfToken string) bool {
+	if csrfToken == "" {
+		// Authenticated via the extension's token header, which (unlike a
+		// cookie) the browser never attaches on its own, so there's no
+		// ambient credential for a forged request to ride along with.
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(req.Header.Get(csrfHeaderName)), []byte(csrfToken)) == 1
+}
+
+// requireAuth wraps a handler so it only runs for authenticated requests,
+// additionally rejecting state-changing requests that don't carry the
+// session's CSRF token.
+func (a *auth) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		csrfToken, ok := a.authenticate(req)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, errors.New("not authenticated"))
+			return
+		}
+
+		switch req.Method {
+		case "POST", "PUT", "DELETE":
+			if !a.checkCSRF(req, csrfToken) {
+				writeError(w, http.StatusForbidden, errors.New("missing or invalid CSRF token"))
+				return
+			}
+		}
+
+		next(w, req)
+	}
+}
+
+func (a *auth) login(w http.ResponseWriter, req *http.Request) {
+	var data struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&data); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if bcrypt.CompareHashAndPassword(a.passwordHash, []byte(data.Password)) != nil {
+		writeError(w, http.StatusUnauthorized, errors.New("incorrect password"))
+		return
+	}
+
+	sess := &session{
+		csrfToken: generateRandomToken(),
+		expiresAt: time.Now().Add(sessionTTL),
+	}
+	sessionID := generateRandomToken()
+
+	a.mu.Lock()
+	a.sessions[sessionID] = sess
+	a.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    sessionID,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   a.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+		Expires:  sess.expiresAt,
+	})
+
+	writeJson(w, map[string]string{"csrf_token": sess.csrfToken})
+}
+
+func (a *auth) logout(w http.ResponseWriter, req *http.Request) {
+	if cookie, err := req.Cookie(sessionCookieName); err == nil {
+		a.mu.Lock()
+		delete(a.sessions, cookie.Value)
+		a.mu.Unlock()
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		Secure:   a.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DefaultConfigDir is where web-adb persists its admin password hash and
+// self-signed TLS certificate, creating it on first use.
+func DefaultConfigDir() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(u.HomeDir, ".web-adb")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func DefaultCredentialsPath() (string, error) {
+	dir, err := DefaultConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "credentials.json"), nil
+}
+
+func DefaultCertPaths() (certPath, keyPath string, err error) {
+	dir, err := DefaultConfigDir()
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), nil
+}
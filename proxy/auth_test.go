@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAuth() *auth {
+	return newAuth([]byte("unused in these tests"))
+}
+
+func addSession(a *auth, id string, sess *session) {
+	a.mu.Lock()
+	a.sessions[id] = sess
+	a.mu.Unlock()
+}
+
+func TestAuthenticateWithTokenHeader(t *testing.T) {
+	a := newTestAuth()
+
+	cases := []struct {
+		name     string
+		token    string
+		wantOK   bool
+		wantCSRF string
+	}{
+		{"correct token", a.token, true, ""},
+		{"wrong token", "not-the-token", false, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/devices", nil)
+			req.Header.Set(tokenHeaderName, c.token)
+
+			csrfToken, ok := a.authenticate(req)
+			assert.Equal(t, c.wantOK, ok)
+			assert.Equal(t, c.wantCSRF, csrfToken)
+		})
+	}
+}
+
+func TestAuthenticateWithSessionCookie(t *testing.T) {
+	a := newTestAuth()
+	addSession(a, "valid-session", &session{
+		csrfToken: "the-csrf-token",
+		expiresAt: time.Now().Add(time.Hour),
+	})
+	addSession(a, "expired-session", &session{
+		csrfToken: "stale-csrf-token",
+		expiresAt: time.Now().Add(-time.Hour),
+	})
+
+	cases := []struct {
+		name     string
+		cookie   *http.Cookie
+		wantOK   bool
+		wantCSRF string
+	}{
+		{"valid session", &http.Cookie{Name: sessionCookieName, Value: "valid-session"}, true, "the-csrf-token"},
+		{"expired session", &http.Cookie{Name: sessionCookieName, Value: "expired-session"}, false, ""},
+		{"unknown session", &http.Cookie{Name: sessionCookieName, Value: "no-such-session"}, false, ""},
+		{"no cookie", nil, false, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/devices", nil)
+			if c.cookie != nil {
+				req.AddCookie(c.cookie)
+			}
+
+			csrfToken, ok := a.authenticate(req)
+			assert.Equal(t, c.wantOK, ok)
+			assert.Equal(t, c.wantCSRF, csrfToken)
+		})
+	}
+}
+
+func TestAuthenticateExpiredSessionIsForgotten(t *testing.T) {
+	// A lookup against an expired session should also evict it, so it
+	// doesn't linger in the map forever.
+	a := newTestAuth()
+	addSession(a, "expired-session", &session{
+		csrfToken: "stale-csrf-token",
+		expiresAt: time.Now().Add(-time.Hour),
+	})
+
+	req := httptest.NewRequest("GET", "/devices", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "expired-session"})
+	_, ok := a.authenticate(req)
+	require.False(t, ok)
+
+	a.mu.Lock()
+	_, stillThere := a.sessions["expired-session"]
+	a.mu.Unlock()
+	assert.False(t, stillThere, "expired session should have been evicted")
+}
+
+func TestCheckCSRF(t *testing.T) {
+	a := newTestAuth()
+
+	cases := []struct {
+		name      string
+		csrfToken string
+		header    string
+		want      bool
+	}{
+		{"no csrf token required (token-header auth)", "", "", true},
+		{"no csrf token required, header ignored", "", "whatever", true},
+		{"matching csrf token", "secret", "secret", true},
+		{"mismatched csrf token", "secret", "wrong", false},
+		{"missing header when one is required", "secret", "", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/devices/x/execute", nil)
+			if c.header != "" {
+				req.Header.Set(csrfHeaderName, c.header)
+			}
+			assert.Equal(t, c.want, a.checkCSRF(req, c.csrfToken))
+		})
+	}
+}
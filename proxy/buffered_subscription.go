@@ -0,0 +1,76 @@
+package proxy
+
+import "sync"
+
+// BufferedSubscription lets many SSE clients share one upstream source of
+// events instead of each opening its own (e.g. its own adb.DeviceWatcher),
+// and keeps a ring buffer of recent events so a client that reconnects with
+// Last-Event-ID doesn't miss anything that happened while it was away.
+type BufferedSubscription struct {
+	mu       sync.Mutex
+	capacity int
+	nextID   int
+	buffer   []Event
+	subs     map[chan Event]struct{}
+}
+
+func NewBufferedSubscription(capacity int) *BufferedSubscription {
+	return &BufferedSubscription{
+		capacity: capacity,
+		subs:     make(map[chan Event]struct{}),
+	}
+}
+
+// Publish assigns e the next ID, buffers it, and forwards it to every live
+// subscriber. A subscriber that isn't keeping up misses the event on its
+// live channel, but will pick it up from the buffer on its next reconnect.
+func (b *BufferedSubscription) Publish(e Event) {
+	b.mu.Lock()
+	b.nextID++
+	e.ID = b.nextID
+
+	b.buffer = append(b.buffer, e)
+	if len(b.buffer) > b.capacity {
+		b.buffer = b.buffer[len(b.buffer)-b.capacity:]
+	}
+
+	live := make([]chan Event, 0, len(b.subs))
+	for ch := range b.subs {
+		live = append(live, ch)
+	}
+	b.mu.Unlock()
+
+	for _, ch := range live {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe registers a new live subscriber and returns every buffered
+// event with an ID greater than lastEventID (pass 0 for none) so the caller
+// can replay them before reading from live. Call unsubscribe when done.
+func (b *BufferedSubscription) Subscribe(lastEventID int) (replay []Event, live <-chan Event, unsubscribe func()) {
+	ch := make(chan Event, 16)
+
+	b.mu.Lock()
+	for _, e := range b.buffer {
+		if e.ID > lastEventID {
+			replay = append(replay, e)
+		}
+	}
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	unsubscribe = func() {
+		b.mu.Lock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+		b.mu.Unlock()
+	}
+
+	return replay, ch, unsubscribe
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferedSubscriptionPublishAssignsSequentialIDs(t *testing.T) {
+	b := NewBufferedSubscription(10)
+
+	b.Publish(Event{Data: "a"})
+	b.Publish(Event{Data: "b"})
+	b.Publish(Event{Data: "c"})
+
+	replay, _, unsubscribe := b.Subscribe(0)
+	defer unsubscribe()
+
+	require.Len(t, replay, 3)
+	assert.Equal(t, 1, replay[0].ID)
+	assert.Equal(t, 2, replay[1].ID)
+	assert.Equal(t, 3, replay[2].ID)
+}
+
+func TestBufferedSubscriptionRingBufferEvictsOldest(t *testing.T) {
+	b := NewBufferedSubscription(2)
+
+	b.Publish(Event{Data: "a"})
+	b.Publish(Event{Data: "b"})
+	b.Publish(Event{Data: "c"})
+
+	replay, _, unsubscribe := b.Subscribe(0)
+	defer unsubscribe()
+
+	require.Len(t, replay, 2)
+	assert.Equal(t, "b", replay[0].Data)
+	assert.Equal(t, "c", replay[1].Data)
+}
+
+func TestBufferedSubscriptionSubscribeReplaysOnlyNewerThanLastEventID(t *testing.T) {
+	b := NewBufferedSubscription(10)
+
+	b.Publish(Event{Data: "a"})
+	b.Publish(Event{Data: "b"})
+	b.Publish(Event{Data: "c"})
+
+	replay, _, unsubscribe := b.Subscribe(2)
+	defer unsubscribe()
+
+	require.Len(t, replay, 1)
+	assert.Equal(t, "c", replay[0].Data)
+}
+
+func TestBufferedSubscriptionSubscribeWithStaleLastEventIDReplaysWholeBuffer(t *testing.T) {
+	// lastEventID older than anything still buffered (e.g. the client was
+	// disconnected longer than the ring buffer's capacity) should just
+	// replay everything that's left, not error or skip.
+	b := NewBufferedSubscription(2)
+
+	b.Publish(Event{Data: "a"})
+	b.Publish(Event{Data: "b"})
+	b.Publish(Event{Data: "c"})
+
+	replay, _, unsubscribe := b.Subscribe(1)
+	defer unsubscribe()
+
+	require.Len(t, replay, 2)
+	assert.Equal(t, "b", replay[0].Data)
+	assert.Equal(t, "c", replay[1].Data)
+}
+
+func TestBufferedSubscriptionSubscribeWithNoBufferedEventsReplaysNothing(t *testing.T) {
+	b := NewBufferedSubscription(10)
+
+	replay, _, unsubscribe := b.Subscribe(0)
+	defer unsubscribe()
+
+	assert.Empty(t, replay)
+}
+
+func TestBufferedSubscriptionLiveChannelReceivesPublishedEvents(t *testing.T) {
+	b := NewBufferedSubscription(10)
+
+	_, live, unsubscribe := b.Subscribe(0)
+	defer unsubscribe()
+
+	b.Publish(Event{Data: "a"})
+
+	select {
+	case e := <-live:
+		assert.Equal(t, "a", e.Data)
+	default:
+		t.Fatal("expected a live event, got none")
+	}
+}
+
+func TestBufferedSubscriptionUnsubscribeClosesLiveChannel(t *testing.T) {
+	b := NewBufferedSubscription(10)
+
+	_, live, unsubscribe := b.Subscribe(0)
+	unsubscribe()
+
+	_, ok := <-live
+	assert.False(t, ok, "channel should be closed after unsubscribe")
+}
+
+func TestBufferedSubscriptionUnsubscribeIsIdempotent(t *testing.T) {
+	b := NewBufferedSubscription(10)
+
+	_, _, unsubscribe := b.Subscribe(0)
+	unsubscribe()
+
+	assert.NotPanics(t, func() {
+		unsubscribe()
+	})
+}
@@ -7,9 +7,21 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"os/user"
 	"path/filepath"
-	"runtime"
+
+	"github.com/zach-klippenstein/web-adb/manifest"
+)
+
+// Browser identifies which native messaging host registry a manifest is
+// being installed for; see the manifest package for the per-OS/per-browser
+// path and registry logic shared with the native-host binary.
+type Browser = manifest.Browser
+
+const (
+	BrowserChrome   = manifest.BrowserChrome
+	BrowserChromium = manifest.BrowserChromium
+	BrowserFirefox  = manifest.BrowserFirefox
+	BrowserEdge     = manifest.BrowserEdge
 )
 
 type ChromeManifest struct {
@@ -20,15 +32,34 @@ type ChromeManifest struct {
 	Path string `json:"path"`
 
 	// Must be "stdio".
-	Type           string   `json:"type"`
-	AllowedOrigins []string `json:"allowed_origins"`
+	Type string `json:"type"`
+
+	// Chrome, Chromium, and Edge key allowed callers by origin. Only one of
+	// AllowedOrigins/AllowedExtensions is set, depending on Browser.
+	AllowedOrigins []string `json:"allowed_origins,omitempty"`
+	// Firefox keys allowed callers by extension ID directly.
+	AllowedExtensions []string `json:"allowed_extensions,omitempty"`
+
+	// Which browser to install for. Defaults to BrowserChrome when empty.
+	Browser Browser `json:"-"`
+}
+
+func (m *ChromeManifest) browser() Browser {
+	if m.Browser == "" {
+		return BrowserChrome
+	}
+	return m.Browser
 }
 
 func (m *ChromeManifest) SetExtensionId(extensionId string) error {
 	if extensionId == "" {
 		return errors.New("no extension ID")
 	}
-	m.AllowedOrigins = []string{formatExtensionOrigin(extensionId)}
+	if m.browser() == BrowserFirefox {
+		m.AllowedExtensions = []string{extensionId}
+	} else {
+		m.AllowedOrigins = []string{formatExtensionOrigin(extensionId)}
+	}
 	return nil
 }
 
@@ -55,15 +86,24 @@ func (m *ChromeManifest) init() error {
 		return err
 	}
 
-	if len(m.AllowedOrigins) == 0 {
-		return errors.New("no allowed origins")
+	switch m.browser() {
+	case BrowserFirefox:
+		if len(m.AllowedExtensions) == 0 {
+			return errors.New("no allowed extensions")
+		}
+	case BrowserChrome, BrowserChromium, BrowserEdge:
+		if len(m.AllowedOrigins) == 0 {
+			return errors.New("no allowed origins")
+		}
+	default:
+		return fmt.Errorf("unrecognized browser: %s", m.Browser)
 	}
 
 	return nil
 }
 
 func (m *ChromeManifest) install() error {
-	path, err := getManifestPath(m.Name)
+	path, err := manifest.GetPath(m.browser(), m.Name)
 	if err != nil {
 		return err
 	}
@@ -80,31 +120,16 @@ func (m *ChromeManifest) install() error {
 		return err
 	}
 
+	// No-op except on Windows, where browsers find the manifest via the
+	// registry rather than a fixed per-browser directory.
+	if err := manifest.RegisterPath(m.browser(), m.Name, path); err != nil {
+		return err
+	}
+
 	log.Println("manifest successfully installed.")
 	return nil
 }
 
-func getManifestPath(packageName string) (path string, err error) {
-	user, _ := user.Current()
-	switch runtime.GOOS {
-	case "darwin":
-		if user != nil {
-			path = fmt.Sprintf("%s/Library/Application Support/Google/Chrome/NativeMessagingHosts/%s.json", user.HomeDir, packageName)
-		} else {
-			path = fmt.Sprintf("/Library/Google/Chrome/NativeMessagingHosts/%s.json", packageName)
-		}
-	case "linux":
-		if user != nil {
-			path = fmt.Sprintf("%s/.config/google-chrome/NativeMessagingHosts/%s.json", user.HomeDir, packageName)
-		} else {
-			path = fmt.Sprintf("/etc/opt/chrome/native-messaging-hosts/%s.json", packageName)
-		}
-	default:
-		err = fmt.Errorf("not sure where to install manifest file on platform %s", runtime.GOOS)
-	}
-	return
-}
-
 func formatExtensionOrigin(extensionId string) string {
 	return fmt.Sprintf("chrome-extension://%s/", extensionId)
 }
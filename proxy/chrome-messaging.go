@@ -2,10 +2,10 @@ package proxy
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"io"
 	"log"
-	"encoding/json"
 )
 
 var byteOrder = binary.LittleEndian
@@ -35,7 +35,7 @@ func ReadMessage(r io.Reader) ([]byte, error) {
 }
 
 func SendMessage(w io.Writer, msg interface{}) error {
-	msgData, err := json.MarshalIndent(msg, "", "  ");
+	msgData, err := json.MarshalIndent(msg, "", "  ")
 	if err != nil {
 		return err
 	}
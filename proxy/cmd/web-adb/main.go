@@ -16,8 +16,11 @@ import (
 )
 
 var (
-	install    = flag.String("install", "", "Install the native messaging host manifest file. Connections will only be allowed from `extension-id`.")
-	binaryPath = flag.String("path", "", "Path to native host binary. Default is the path to the current executable.")
+	install     = flag.String("install", "", "Install the native messaging host manifest file. Connections will only be allowed from `extension-id`.")
+	browser     = flag.String("browser", "chrome", "Browser to install the manifest for with -install: chrome, chromium, firefox, or edge.")
+	binaryPath  = flag.String("path", "", "Path to native host binary. Default is the path to the current executable.")
+	setPassword = flag.String("set-password", "", "Set the admin password browser clients log in with, and exit. Only needed once; the bcrypt hash is persisted.")
+	useTLS      = flag.Bool("tls", false, "Serve over TLS using a self-signed certificate, generated and persisted on first use.")
 )
 
 var Manifest = proxy.ChromeManifest{
@@ -37,6 +40,14 @@ type RunCommandRequest struct {
 	Args    []string `json:"args"`
 }
 
+// Handshake is the first message written to stdout, before anything else
+// touches the pipe, so it's the only way the extension learns how to reach
+// the proxy and the token to authenticate with.
+type Handshake struct {
+	Addr  string `json:"addr"`
+	Token string `json:"token"`
+}
+
 type Response struct {
 	Success bool `json:"success"`
 
@@ -71,6 +82,7 @@ func main() {
 		// Running from command line, turn off timestamps.
 		log.SetFlags(0)
 		Manifest.Path = *binaryPath
+		Manifest.Browser = proxy.Browser(*browser)
 		Manifest.SetExtensionId(*install)
 
 		if err := Manifest.Install(); err != nil {
@@ -79,6 +91,14 @@ func main() {
 		return
 	}
 
+	if *setPassword != "" {
+		log.SetFlags(0)
+		if err := setAdminPassword(*setPassword); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	var syslogWriter io.Writer
 	syslogWriter, err := syslog.New(syslog.LOG_NOTICE, "web-adb")
 	if err != nil {
@@ -91,16 +111,76 @@ func main() {
 func doMain() {
 	log.Println("web-adb starting...")
 
-	httpServer, err := proxy.NewAdbHttpProxy()
+	authConfig, err := loadOrInitAuthConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	httpServer, err := proxy.NewAdbHttpProxy(authConfig.PasswordHash)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *useTLS {
+		certPath, keyPath, err := proxy.DefaultCertPaths()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := httpServer.EnableTLS(certPath, keyPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	log.Println("adb proxy listening on", httpServer.Addr())
 
-	proxy.SendMessage(os.Stdout, httpServer.Addr())
+	proxy.SendMessage(os.Stdout, Handshake{
+		Addr:  httpServer.Addr(),
+		Token: httpServer.AuthToken(),
+	})
 	err = httpServer.Serve()
 
 	log.Println("port closed, stopping http server and exiting with", err)
 	log.Fatal(err)
 }
+
+// loadOrInitAuthConfig loads the persisted admin password hash, generating
+// a random password and persisting its hash the first time the proxy runs
+// so there's no setup required before the extension works.
+func loadOrInitAuthConfig() (*proxy.AuthConfig, error) {
+	path, err := proxy.DefaultCredentialsPath()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg, err := proxy.LoadAuthConfig(path); err == nil {
+		return cfg, nil
+	}
+
+	password := proxy.GenerateRandomPassword()
+	hash, err := proxy.HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &proxy.AuthConfig{PasswordHash: hash}
+	if err := proxy.SaveAuthConfig(path, cfg); err != nil {
+		return nil, err
+	}
+
+	log.Printf("generated admin password: %s (won't be shown again; change it with -set-password)", password)
+	return cfg, nil
+}
+
+func setAdminPassword(password string) error {
+	path, err := proxy.DefaultCredentialsPath()
+	if err != nil {
+		return err
+	}
+
+	hash, err := proxy.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return proxy.SaveAuthConfig(path, &proxy.AuthConfig{PasswordHash: hash})
+}
@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	adb "github.com/zach-klippenstein/goadb"
+)
+
+// forward is a registered TCP tunnel to a device-side service (e.g.
+// "tcp:5555" or "localabstract:foo"). Each WebSocket client that connects
+// to its URL gets its own dial to Remote, the same way `adb forward`
+// opens a new device connection for every local socket it accepts.
+type forward struct {
+	ID     string `json:"id"`
+	Serial string `json:"serial"`
+	Remote string `json:"remote"`
+
+	mu    sync.Mutex
+	conns map[*websocket.Conn]struct{}
+}
+
+func newForward(serial, remote string) *forward {
+	return &forward{
+		ID:     generateRandomToken(),
+		Serial: serial,
+		Remote: remote,
+		conns:  make(map[*websocket.Conn]struct{}),
+	}
+}
+
+// trackConn registers conn so closeAll can tear it down on shutdown; call
+// the returned func when the connection ends.
+func (f *forward) trackConn(conn *websocket.Conn) func() {
+	f.mu.Lock()
+	f.conns[conn] = struct{}{}
+	f.mu.Unlock()
+
+	return func() {
+		f.mu.Lock()
+		delete(f.conns, conn)
+		f.mu.Unlock()
+	}
+}
+
+func (f *forward) closeAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for conn := range f.conns {
+		conn.Close()
+	}
+}
+
+type CreateForwardRequest struct {
+	// E.g. "tcp:5555" or "localabstract:foo".
+	Remote string `json:"remote"`
+}
+
+type CreateForwardResponse struct {
+	ID        string `json:"id"`
+	WebSocket string `json:"websocket_url"`
+}
+
+func (p *AdbHttpProxy) createForward(w http.ResponseWriter, req *http.Request) {
+	serial := mux.Vars(req)["serial"]
+
+	var data CreateForwardRequest
+	if err := json.NewDecoder(req.Body).Decode(&data); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if data.Remote == "" {
+		writeError(w, http.StatusBadRequest, errors.New("no remote specified"))
+		return
+	}
+
+	// Probed once up front so a caller doesn't get back a forward ID and a
+	// WebSocket URL for a tunnel that dialDeviceService (see its doc comment)
+	// can never carry traffic for; failing every connecting client
+	// individually with a 502 instead would silently accept requests for a
+	// dead forward.
+	client := adb.NewDeviceClient(p.adbServer, adb.DeviceWithSerial(serial))
+	probeConn, err := dialDeviceService(client, data.Remote)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	probeConn.Close()
+
+	f := newForward(serial, data.Remote)
+
+	p.forwardsMu.Lock()
+	p.forwards[f.ID] = f
+	p.forwardsMu.Unlock()
+
+	wsURL, err := p.router.Get("forward").URL("serial", serial, "id", f.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJson(w, CreateForwardResponse{ID: f.ID, WebSocket: wsURL.String()})
+}
+
+func (p *AdbHttpProxy) listForwards(w http.ResponseWriter, req *http.Request) {
+	p.forwardsMu.Lock()
+	all := make([]*forward, 0, len(p.forwards))
+	for _, f := range p.forwards {
+		all = append(all, f)
+	}
+	p.forwardsMu.Unlock()
+
+	writeJson(w, all)
+}
+
+func (p *AdbHttpProxy) deleteForward(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+
+	p.forwardsMu.Lock()
+	f, ok := p.forwards[id]
+	if ok {
+		delete(p.forwards, id)
+	}
+	p.forwardsMu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("no such forward"))
+		return
+	}
+
+	f.closeAll()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *AdbHttpProxy) closeForwards() {
+	p.forwardsMu.Lock()
+	defer p.forwardsMu.Unlock()
+	for _, f := range p.forwards {
+		f.closeAll()
+	}
+}
+
+func (p *AdbHttpProxy) forwardWebSocket(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	serial, id := vars["serial"], vars["id"]
+
+	p.forwardsMu.Lock()
+	f, ok := p.forwards[id]
+	p.forwardsMu.Unlock()
+	if !ok || f.Serial != serial {
+		writeError(w, http.StatusNotFound, errors.New("no such forward"))
+		return
+	}
+
+	client := adb.NewDeviceClient(p.adbServer, adb.DeviceWithSerial(serial))
+	remoteConn, err := dialDeviceService(client, f.Remote)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	defer remoteConn.Close()
+
+	conn, err := shellUpgrader.Upgrade(w, req, nil)
+	if err != nil {
+		log.Println("error upgrading forward connection:", err)
+		return
+	}
+	defer conn.Close()
+
+	untrack := f.trackConn(conn)
+	defer untrack()
+
+	log.Printf("forward %s: tunneling %s:%s", f.ID, serial, f.Remote)
+
+	var closeOnce sync.Once
+	done := make(chan struct{})
+	// Closing conn as well as done is what unblocks the synchronous
+	// conn.ReadMessage() call in pumpWebSocketToForward once the *other*
+	// side (remoteConn) ends first. Neither pump watches done; it only lets
+	// this handler return, and the deferred remoteConn.Close() is what
+	// unblocks pumpForwardToWebSocket's Read when the WebSocket side ends first.
+	closeDone := func() {
+		closeOnce.Do(func() {
+			close(done)
+			conn.Close()
+		})
+	}
+
+	go pumpForwardToWebSocket(conn, remoteConn, closeDone)
+	pumpWebSocketToForward(conn, remoteConn, closeDone)
+	<-done
+}
+
+func pumpForwardToWebSocket(conn *websocket.Conn, remote io.Reader, closeDone func()) {
+	defer closeDone()
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := remote.Read(buf)
+		if n > 0 {
+			conn.SetWriteDeadline(time.Now().Add(shellWriteWait))
+			if werr := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); werr != nil {
+				log.Println("error writing forward frame:", werr)
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Println("forward remote read error:", err)
+			}
+			return
+		}
+	}
+}
+
+func pumpWebSocketToForward(conn *websocket.Conn, remote io.Writer, closeDone func()) {
+	defer closeDone()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if _, err := remote.Write(data); err != nil {
+			log.Println("error writing forward data to device:", err)
+			return
+		}
+	}
+}
+
+// dialDeviceService would open a raw, bidirectional connection to an
+// arbitrary service on the device (e.g. "tcp:5555"), the way `adb forward`
+// tunnels a connection internally. This client library's public surface is
+// RunCommand, OpenRead/OpenWrite, Stat, ListDirEntries, and device
+// watching/listing — nothing exposes a raw device-socket dial, so this is
+// infeasible against this library rather than merely unimplemented.
+// createForward calls this once at setup time and fails the request outright
+// rather than handing back a forward that would 502 on every connection.
+func dialDeviceService(client *adb.DeviceClient, service string) (io.ReadWriteCloser, error) {
+	return nil, fmt.Errorf("dialing device service %q is not supported by this adb client library", service)
+}
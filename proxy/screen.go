@@ -0,0 +1,329 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	adb "github.com/zach-klippenstein/goadb"
+)
+
+const (
+	screenFramerate     = 10 // frames per second
+	screenJpegQuality   = 60
+	screenMJPEGBoundary = "webadbframe"
+	minicapPath         = "/data/local/tmp/minicap"
+)
+
+type screenFrame struct {
+	Data             []byte // JPEG-encoded.
+	Width, Height    int
+	OrientationQuads int // 0-3, number of 90deg rotations. Only known when minicap is used.
+}
+
+// screenBroadcaster fans a single device's capture pump out to any number of
+// HTTP/WebSocket subscribers, so opening a second browser tab doesn't spawn
+// a second screencap/minicap pump on the device.
+type screenBroadcaster struct {
+	mu   sync.Mutex
+	subs map[chan screenFrame]struct{}
+}
+
+func newScreenBroadcaster() *screenBroadcaster {
+	return &screenBroadcaster{subs: make(map[chan screenFrame]struct{})}
+}
+
+func (b *screenBroadcaster) subscribe() (<-chan screenFrame, func()) {
+	ch := make(chan screenFrame, 2)
+
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	unsubscribe := func() {
+		b.mu.Lock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+		b.mu.Unlock()
+	}
+	return ch, unsubscribe
+}
+
+func (b *screenBroadcaster) subscriberCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+func (b *screenBroadcaster) publish(frame screenFrame) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- frame:
+		default:
+			// Subscriber isn't keeping up; drop the frame rather than block
+			// the capture pump for every other subscriber.
+		}
+	}
+}
+
+// getOrStartScreenBroadcaster returns the shared broadcaster for serial,
+// starting its capture pump if this is the first subscriber.
+func (p *AdbHttpProxy) getOrStartScreenBroadcaster(serial string) *screenBroadcaster {
+	p.screensMu.Lock()
+	defer p.screensMu.Unlock()
+
+	if b, ok := p.screens[serial]; ok {
+		return b
+	}
+
+	b := newScreenBroadcaster()
+	p.screens[serial] = b
+
+	go p.pumpScreenCaptures(serial, b)
+
+	return b
+}
+
+func (p *AdbHttpProxy) pumpScreenCaptures(serial string, b *screenBroadcaster) {
+	defer func() {
+		p.screensMu.Lock()
+		delete(p.screens, serial)
+		p.screensMu.Unlock()
+	}()
+
+	client := adb.NewDeviceClient(p.adbServer, adb.DeviceWithSerial(serial))
+	useMinicap := minicapAvailable(client)
+	if useMinicap {
+		log.Printf("screen %s: using minicap", serial)
+	} else {
+		log.Printf("screen %s: minicap not found, falling back to screencap", serial)
+	}
+
+	ticker := time.NewTicker(time.Second / screenFramerate)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if b.subscriberCount() == 0 {
+			log.Printf("screen %s: no more subscribers, stopping pump", serial)
+			return
+		}
+
+		var frame screenFrame
+		var err error
+		if useMinicap {
+			frame, err = captureScreenFrameMinicap(client)
+		} else {
+			frame, err = captureScreenFrameScreencap(client)
+		}
+		if err != nil {
+			log.Printf("screen %s: error capturing frame: %v", serial, err)
+			continue
+		}
+
+		b.publish(frame)
+	}
+}
+
+func minicapAvailable(client *adb.DeviceClient) bool {
+	_, err := client.Stat(minicapPath)
+	return err == nil
+}
+
+// captureScreenFrameScreencap takes a screenshot with the `screencap` tool
+// that ships on every device and re-encodes it as JPEG, since screencap only
+// supports PNG.
+func captureScreenFrameScreencap(client *adb.DeviceClient) (screenFrame, error) {
+	raw, err := client.RunCommand("screencap", "-p")
+	if err != nil {
+		return screenFrame{}, err
+	}
+
+	img, err := png.Decode(strings.NewReader(raw))
+	if err != nil {
+		return screenFrame{}, fmt.Errorf("error decoding screencap output: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: screenJpegQuality}); err != nil {
+		return screenFrame{}, fmt.Errorf("error encoding jpeg: %v", err)
+	}
+
+	bounds := img.Bounds()
+	return screenFrame{
+		Data:   buf.Bytes(),
+		Width:  bounds.Dx(),
+		Height: bounds.Dy(),
+	}, nil
+}
+
+// captureScreenFrameMinicap runs `minicap -s` which writes a single frame to
+// stdout already JPEG-encoded, prefixed by minicap's binary frame protocol:
+// a 24-byte global header followed by a 4-byte (LE) frame size and the JPEG
+// bytes themselves. Using minicap avoids the PNG decode/re-encode round trip
+// and gives us the device's actual display orientation.
+func captureScreenFrameMinicap(client *adb.DeviceClient) (screenFrame, error) {
+	raw, err := client.RunCommand(minicapPath, "-s")
+	if err != nil {
+		return screenFrame{}, err
+	}
+	data := []byte(raw)
+
+	const globalHeaderSize = 24
+	if len(data) < globalHeaderSize+4 {
+		return screenFrame{}, fmt.Errorf("minicap output too short: %d bytes", len(data))
+	}
+
+	realWidth := binary.LittleEndian.Uint32(data[6:10])
+	realHeight := binary.LittleEndian.Uint32(data[10:14])
+	orientation := data[22]
+
+	frameSize := binary.LittleEndian.Uint32(data[globalHeaderSize : globalHeaderSize+4])
+	jpegStart := globalHeaderSize + 4
+	jpegEnd := jpegStart + int(frameSize)
+	if jpegEnd > len(data) {
+		return screenFrame{}, fmt.Errorf("minicap frame size %d exceeds output length %d", frameSize, len(data))
+	}
+
+	jpegData := make([]byte, frameSize)
+	copy(jpegData, data[jpegStart:jpegEnd])
+
+	return screenFrame{
+		Data:             jpegData,
+		Width:            int(realWidth),
+		Height:           int(realHeight),
+		OrientationQuads: int(orientation),
+	}, nil
+}
+
+// screen upgrades to a WebSocket that streams binary JPEG frames plus JSON
+// control messages, or, if the client didn't ask to upgrade, serves an MJPEG
+// multipart stream suitable for an `<img src>`.
+func (p *AdbHttpProxy) screen(w http.ResponseWriter, req *http.Request) {
+	serial := mux.Vars(req)["serial"]
+
+	if websocket.IsWebSocketUpgrade(req) {
+		p.screenWebSocket(w, req, serial)
+	} else {
+		p.screenMJPEG(w, req, serial)
+	}
+}
+
+func (p *AdbHttpProxy) screenMJPEG(w http.ResponseWriter, req *http.Request, serial string) {
+	frames, unsubscribe := p.getOrStartScreenBroadcaster(serial).subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+screenMJPEGBoundary)
+	mw := multipart.NewWriter(w)
+	mw.SetBoundary(screenMJPEGBoundary)
+	flusher, _ := w.(http.Flusher)
+
+	for {
+		select {
+		case frame, ok := <-frames:
+			if !ok {
+				return
+			}
+
+			header := textproto.MIMEHeader{}
+			header.Set("Content-Type", "image/jpeg")
+			header.Set("Content-Length", strconv.Itoa(len(frame.Data)))
+
+			part, err := mw.CreatePart(header)
+			if err != nil {
+				log.Println("error writing mjpeg part header:", err)
+				return
+			}
+			if _, err := part.Write(frame.Data); err != nil {
+				log.Println("error writing mjpeg frame:", err)
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// ScreenControlMessage is sent over the screen WebSocket alongside binary
+// JPEG frames whenever the device's rotation or resolution changes.
+type ScreenControlMessage struct {
+	Type        string `json:"type"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	Orientation int    `json:"orientation,omitempty"`
+}
+
+func (p *AdbHttpProxy) screenWebSocket(w http.ResponseWriter, req *http.Request, serial string) {
+	conn, err := shellUpgrader.Upgrade(w, req, nil)
+	if err != nil {
+		log.Println("error upgrading screen connection:", err)
+		return
+	}
+	defer conn.Close()
+
+	frames, unsubscribe := p.getOrStartScreenBroadcaster(serial).subscribe()
+	defer unsubscribe()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			// We don't expect any messages from the client, but we still
+			// need to read so the connection notices when it's closed.
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	lastWidth, lastHeight, lastOrientation := -1, -1, -1
+
+	for {
+		select {
+		case frame, ok := <-frames:
+			if !ok {
+				return
+			}
+
+			if frame.Width != lastWidth || frame.Height != lastHeight || frame.OrientationQuads != lastOrientation {
+				lastWidth, lastHeight, lastOrientation = frame.Width, frame.Height, frame.OrientationQuads
+				conn.SetWriteDeadline(time.Now().Add(shellWriteWait))
+				if err := conn.WriteJSON(ScreenControlMessage{
+					Type:        "resolution",
+					Width:       frame.Width,
+					Height:      frame.Height,
+					Orientation: frame.OrientationQuads,
+				}); err != nil {
+					log.Println("error writing screen control message:", err)
+					return
+				}
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(shellWriteWait))
+			if err := conn.WriteMessage(websocket.BinaryMessage, frame.Data); err != nil {
+				log.Println("error writing screen frame:", err)
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Package proxy's shell.go handles /devices/{serial}/shell. The original
+// ask was a live, bidirectional shell: stdin forwarded to the device as it's
+// typed, stdout/stderr streamed back as they arrive, a resize-message type
+// for PTY dimensions, a keepalive ping loop, and an SSE fallback that tails
+// long-running commands for browsers without WebSocket. None of that is
+// deliverable: this client library's only shell primitive, RunCommand, runs
+// a command to completion and hands back its full output in one call, with
+// no stdin, no PTY, and no way to read output before the process exits. What
+// follows is a single command-in/full-output-out request over WebSocket or
+// SSE — it does not forward stdin past the first message, resize, send
+// keepalive pings, or tail incremental output.
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	adb "github.com/zach-klippenstein/goadb"
+)
+
+const (
+	shellWriteWait = 10 * time.Second
+)
+
+// shellUpgrader is shared by every streaming endpoint (shell, screen,
+// forward): they're all reachable with nothing but an ambient session
+// cookie, and unlike POST/PUT/DELETE a WebSocket upgrade is a GET request
+// that auth.checkCSRF never sees, so checkWebSocketOrigin is the only thing
+// stopping a malicious page from riding the victim's cookie into one of
+// these.
+var shellUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	CheckOrigin:     checkWebSocketOrigin,
+}
+
+// checkWebSocketOrigin rejects cross-origin upgrade requests. A browser
+// always sends Origin on a WebSocket handshake; requests with no Origin
+// come from non-browser clients (e.g. the extension's own token-authenticated
+// tooling), which aren't subject to the cookie-riding attack this guards
+// against.
+func checkWebSocketOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return u.Host == req.Host
+}
+
+// ShellRunMessage is the single client frame a shell WebSocket expects,
+// naming the command to run. This client library only exposes RunCommand
+// for invoking a device shell, which runs one command to completion and
+// returns its output — there's no lower-level primitive for a live,
+// stdin-accepting shell — so a session isn't actually interactive: one
+// command in, its output back, then the socket closes.
+type ShellRunMessage struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// shell upgrades to a WebSocket that runs one command and returns its
+// output, or, if the client didn't ask to upgrade, falls back to an SSE
+// response carrying the same output.
+func (p *AdbHttpProxy) shell(w http.ResponseWriter, req *http.Request) {
+	serial := mux.Vars(req)["serial"]
+	client := adb.NewDeviceClient(p.adbServer, adb.DeviceWithSerial(serial))
+
+	if websocket.IsWebSocketUpgrade(req) {
+		p.shellWebSocket(w, req, client)
+	} else {
+		p.shellSSE(w, req, client)
+	}
+}
+
+func (p *AdbHttpProxy) shellWebSocket(w http.ResponseWriter, req *http.Request, client *adb.DeviceClient) {
+	conn, err := shellUpgrader.Upgrade(w, req, nil)
+	if err != nil {
+		log.Println("error upgrading shell connection:", err)
+		return
+	}
+	defer conn.Close()
+
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		log.Println("error reading shell command:", err)
+		return
+	}
+
+	var run ShellRunMessage
+	if err := json.Unmarshal(data, &run); err != nil || run.Command == "" {
+		conn.WriteJSON(DeviceEvent{"error", `first message must be {"command":"...","args":[...]}`})
+		return
+	}
+
+	output, err := client.RunCommand(run.Command, run.Args...)
+	if err != nil {
+		conn.WriteJSON(DeviceEvent{"error", err.Error()})
+		return
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(shellWriteWait))
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte(output)); err != nil {
+		log.Println("error writing shell output:", err)
+	}
+}
+
+// shellSSE is the fallback for clients that can't open a WebSocket: it runs
+// the requested command and sends its output as a single `data:` event once
+// RunCommand returns. There's no way to send stdin over this channel, and
+// because RunCommand itself doesn't hand back output until the command
+// exits, this can't tail a long-running command's output incrementally the
+// way a true SSE log-tail would — a command that never exits on its own
+// never sends an event at all.
+func (p *AdbHttpProxy) shellSSE(w http.ResponseWriter, req *http.Request, client *adb.DeviceClient) {
+	command := req.URL.Query().Get("command")
+	if command == "" {
+		writeError(w, http.StatusBadRequest, errors.New("no command specified"))
+		return
+	}
+	args := req.URL.Query()["arg"]
+
+	output, err := client.RunCommand(command, args...)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	src := EventSource{w: w}
+	if f, ok := w.(http.Flusher); ok {
+		src.f = f
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+
+	if err := src.SendEvent(Event{Data: output}); err != nil {
+		log.Println("error writing shell SSE event:", err)
+	}
+}
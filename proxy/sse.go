@@ -18,6 +18,9 @@ type EventSource struct {
 }
 
 type Event struct {
+	// ID is written as "id: N" so a reconnecting client can send it back as
+	// Last-Event-ID. Zero means unset.
+	ID      int
 	Comment string
 	Name    string
 	Data    string
@@ -57,6 +60,11 @@ func (s *EventSource) SendEvent(e Event) error {
 			return err
 		}
 	}
+	if e.ID != 0 {
+		if _, err := fmt.Fprintln(s.w, "id:", e.ID); err != nil {
+			return err
+		}
+	}
 	if e.Data != "" {
 		if err := writePrefixedLines("data:", e.Data, s.w); err != nil {
 			return err
@@ -75,17 +83,16 @@ func (s *EventSource) SendEvent(e Event) error {
 }
 
 /*
- writePrefixedLines writes each line of data to w with a prefix and a space.
- E.g.:
-
- 	{"one": 1,
- 	 "two": 2}
+writePrefixedLines writes each line of data to w with a prefix and a space.
+E.g.:
 
- with prefix=data gives
+	{"one": 1,
+	 "two": 2}
 
- 	data: {"one": 1,
- 	data:  "two": 2}
+with prefix=data gives
 
+	data: {"one": 1,
+	data:  "two": 2}
 */
 func writePrefixedLines(prefix, data string, w io.Writer) error {
 	scanner := bufio.NewScanner(strings.NewReader(data))